@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"authService/db"
+	"authService/password"
+	"authService/server"
+
+	"github.com/google/uuid"
+	"golang.org/x/term"
+)
+
+const usage = `Usage: authService <command> [arguments]
+
+Commands:
+  serve                                   start the HTTP server (default)
+  migrate up                              apply pending migrations
+  migrate status                          list migrations and when they were applied
+  user create -username U -login L [-email E]
+                                          create a user, password is read from stdin
+  user reset-password <user>              set a new password read from stdin
+                                          and end all sessions of the user
+  user set-role [-revoke] <user> <role>   grant or revoke a role
+  group add-member <group-id> <user>      add a user to a group
+  token inspect [token]                   decode an access token (or read it from stdin)
+
+<user> is a user id, login or username. When a login and a username
+belong to different users, pass the user id.
+`
+
+// run выполняет подкоманду. Всё, кроме serve, работает с той же базой
+// и той же логикой, что и обработчики, и пишет действия в журнал аудита.
+func run(args []string) error {
+	switch args[0] {
+	case "serve":
+		serve()
+		return nil
+	case "migrate":
+		return runMigrate(args[1:])
+	case "user":
+		return runUser(args[1:])
+	case "group":
+		return runGroup(args[1:])
+	case "token":
+		return runToken(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// withDatabase открывает базу на время одной команды.
+func withDatabase(fn func(ctx context.Context, database *db.Database) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	database, err := openDatabase(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer database.Close()
+	return fn(ctx, database)
+}
+
+func subcommand(args []string, group string, names ...string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("%s: expected one of: %s", group, strings.Join(names, ", "))
+	}
+	for _, name := range names {
+		if args[0] == name {
+			return name, args[1:], nil
+		}
+	}
+	return "", nil, fmt.Errorf("%s: unknown subcommand %q", group, args[0])
+}
+
+// parseFlags разбирает флаги и проверяет число позиционных аргументов.
+func parseFlags(fs *flag.FlagSet, args []string, positional ...string) ([]string, error) {
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), strings.TrimSpace("Usage: authService "+fs.Name()+" [flags] "+strings.Join(positional, " ")))
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != len(positional) {
+		fs.Usage()
+		return nil, fmt.Errorf("%s: expected %d argument(s), got %d", fs.Name(), len(positional), fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+// readSecret читает одну строку из stdin, чтобы пароль не попадал
+// в историю оболочки и в список процессов. С терминала ввод не отображается.
+func readSecret(prompt string) (string, error) {
+	var line string
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		secret, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		line = string(secret)
+	} else {
+		var err error
+		line, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("empty input")
+	}
+	return line, nil
+}
+
+// describe раскрывает нарушения политики паролей построчно.
+func describe(err error) error {
+	var policyErr *password.PolicyError
+	if !errors.As(err, &policyErr) {
+		return err
+	}
+	lines := make([]string, len(policyErr.Violations))
+	for i, v := range policyErr.Violations {
+		lines[i] = fmt.Sprintf("  %s: %s", v.Rule, v.Message)
+	}
+	return fmt.Errorf("password rejected:\n%s", strings.Join(lines, "\n"))
+}
+
+func runMigrate(args []string) error {
+	name, _, err := subcommand(args, "migrate", "up", "status")
+	if err != nil {
+		return err
+	}
+	return withDatabase(func(ctx context.Context, database *db.Database) error {
+		if name == "up" {
+			return database.RunMigrations(ctx)
+		}
+
+		status, err := database.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "MIGRATION\tAPPLIED AT")
+		pending := 0
+		for _, m := range status {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = m.AppliedAt.Local().Format(time.RFC3339)
+			} else {
+				pending++
+			}
+			fmt.Fprintf(w, "%s\t%s\n", m.Name, applied)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Printf("%d pending\n", pending)
+		return nil
+	})
+}
+
+func runUser(args []string) error {
+	name, args, err := subcommand(args, "user", "create", "reset-password", "set-role")
+	if err != nil {
+		return err
+	}
+
+	switch name {
+	case "create":
+		fs := flag.NewFlagSet("user create", flag.ContinueOnError)
+		var u server.NewUser
+		fs.StringVar(&u.Username, "username", "", "username shown to other users")
+		fs.StringVar(&u.Login, "login", "", "login used to sign in")
+		fs.StringVar(&u.Email, "email", "", "email address (optional)")
+		if _, err := parseFlags(fs, args); err != nil {
+			return err
+		}
+		if u.Username == "" || u.Login == "" {
+			return fmt.Errorf("user create: -username and -login are required")
+		}
+		if u.Password, err = readSecret("Password: "); err != nil {
+			return fmt.Errorf("failed to read password: %w", err)
+		}
+		hasher, policy, err := passwordSetup()
+		if err != nil {
+			return err
+		}
+		return withDatabase(func(ctx context.Context, database *db.Database) error {
+			userID, err := server.CreateUser(ctx, database, hasher, policy, u)
+			if err != nil {
+				return describe(err)
+			}
+			fmt.Printf("Created user %s (%s)\n", u.Username, userID)
+			return nil
+		})
+
+	case "reset-password":
+		fs := flag.NewFlagSet("user reset-password", flag.ContinueOnError)
+		pos, err := parseFlags(fs, args, "<user>")
+		if err != nil {
+			return err
+		}
+		newPassword, err := readSecret("New password: ")
+		if err != nil {
+			return fmt.Errorf("failed to read password: %w", err)
+		}
+		hasher, policy, err := passwordSetup()
+		if err != nil {
+			return err
+		}
+		return withDatabase(func(ctx context.Context, database *db.Database) error {
+			revoked, err := server.ResetUserPassword(ctx, database, hasher, policy, pos[0], newPassword)
+			if err != nil {
+				return describe(err)
+			}
+			fmt.Printf("Password updated, %d session(s) ended\n", revoked)
+			return nil
+		})
+
+	default:
+		fs := flag.NewFlagSet("user set-role", flag.ContinueOnError)
+		revoke := fs.Bool("revoke", false, "revoke the role instead of granting it")
+		pos, err := parseFlags(fs, args, "<user>", "<role>")
+		if err != nil {
+			return err
+		}
+		return withDatabase(func(ctx context.Context, database *db.Database) error {
+			if err := server.SetUserRole(ctx, database, pos[0], pos[1], !*revoke); err != nil {
+				return err
+			}
+			if *revoke {
+				fmt.Printf("Role %s revoked from %s\n", pos[1], pos[0])
+			} else {
+				fmt.Printf("Role %s granted to %s\n", pos[1], pos[0])
+			}
+			return nil
+		})
+	}
+}
+
+func runGroup(args []string) error {
+	_, args, err := subcommand(args, "group", "add-member")
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("group add-member", flag.ContinueOnError)
+	pos, err := parseFlags(fs, args, "<group-id>", "<user>")
+	if err != nil {
+		return err
+	}
+	groupID, err := uuid.Parse(pos[0])
+	if err != nil {
+		return fmt.Errorf("invalid group id %q", pos[0])
+	}
+	return withDatabase(func(ctx context.Context, database *db.Database) error {
+		added, err := server.AddGroupMember(ctx, database, groupID, pos[1])
+		if err != nil {
+			return err
+		}
+		if added {
+			fmt.Printf("Added %s to group %s\n", pos[1], groupID)
+		} else {
+			fmt.Printf("%s is already in group %s\n", pos[1], groupID)
+		}
+		return nil
+	})
+}
+
+func runToken(args []string) error {
+	_, args, err := subcommand(args, "token", "inspect")
+	if err != nil {
+		return err
+	}
+	var raw string
+	switch len(args) {
+	case 0:
+		if raw, err = readSecret("Token: "); err != nil {
+			return fmt.Errorf("failed to read token: %w", err)
+		}
+	case 1:
+		raw = args[0]
+	default:
+		return fmt.Errorf("token inspect: expected at most one argument")
+	}
+	raw = strings.TrimSpace(strings.TrimPrefix(raw, "Bearer "))
+
+	return withDatabase(func(ctx context.Context, database *db.Database) error {
+		manager, err := newKeyManager(database, envDuration("ACCESS_TOKEN_TTL", 15*time.Minute))
+		if err != nil {
+			return err
+		}
+		// Только чтение ключей: инспекция не должна запускать ротацию.
+		if err := manager.Load(ctx); err != nil {
+			return err
+		}
+		tokens := server.NewTokenIssuer(manager, 0, 0)
+
+		claims, revoked, err := server.InspectToken(ctx, database, tokens, raw)
+		if err != nil {
+			return fmt.Errorf("invalid token: %w", err)
+		}
+		out, err := json.MarshalIndent(struct {
+			Revoked bool `json:"revoked"`
+			*server.Claims
+		}{revoked, claims}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	})
+}
+
+func passwordSetup() (*password.Hasher, password.Policy, error) {
+	hasher, err := password.NewHasher(passwordParams())
+	if err != nil {
+		return nil, password.Policy{}, fmt.Errorf("failed to configure password hashing: %w", err)
+	}
+	policy, err := passwordPolicy()
+	if err != nil {
+		return nil, password.Policy{}, fmt.Errorf("failed to configure password policy: %w", err)
+	}
+	return hasher, policy, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"time"
 )
 
 type Migration struct {
@@ -53,6 +54,384 @@ var migrations = []Migration{
         ON CONFLICT (id) DO NOTHING;
 		`,
 	},
+	{
+		Name: "refresh_tokens",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS refresh_tokens (
+				id UUID PRIMARY KEY DEFAULT uuidv4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				family_id UUID NOT NULL,
+				token_hash VARCHAR(64) UNIQUE NOT NULL,
+				replaced_by UUID REFERENCES refresh_tokens(id) ON DELETE SET NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				rotated_at TIMESTAMP WITH TIME ZONE,
+				revoked_at TIMESTAMP WITH TIME ZONE
+			);
+			CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+			CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+		`,
+	},
+	{
+		Name: "revoked_tokens",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS revoked_tokens (
+				jti UUID PRIMARY KEY,
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				revoked_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE INDEX IF NOT EXISTS idx_revoked_tokens_expires_at ON revoked_tokens(expires_at);
+			ALTER TABLE auth ADD COLUMN IF NOT EXISTS tokens_valid_after TIMESTAMP WITH TIME ZONE;
+		`,
+	},
+	{
+		Name: "signing_keys",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS signing_keys (
+				kid VARCHAR(64) PRIMARY KEY,
+				algorithm VARCHAR(16) NOT NULL,
+				private_key BYTEA NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				retires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+			);
+		`,
+	},
+	{
+		Name: "sessions",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS sessions (
+				id UUID PRIMARY KEY DEFAULT uuidv4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				device_name VARCHAR(100),
+				user_agent TEXT,
+				ip VARCHAR(45),
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				last_seen_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				revoked_at TIMESTAMP WITH TIME ZONE
+			);
+			CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+			DROP INDEX IF EXISTS idx_auth_jwt;
+			ALTER TABLE auth DROP COLUMN IF EXISTS jwt;
+		`,
+	},
+	{
+		Name: "two_factor",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS user_totp (
+				user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+				secret VARCHAR(64) NOT NULL,
+				enabled_at TIMESTAMP WITH TIME ZONE,
+				last_used_step BIGINT NOT NULL DEFAULT 0,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE TABLE IF NOT EXISTS recovery_codes (
+				id UUID PRIMARY KEY DEFAULT uuidv4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				code_hash VARCHAR(64) NOT NULL,
+				used_at TIMESTAMP WITH TIME ZONE,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE (user_id, code_hash)
+			);
+			CREATE TABLE IF NOT EXISTS login_challenges (
+				id UUID PRIMARY KEY DEFAULT uuidv4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				token_hash VARCHAR(64) UNIQUE NOT NULL,
+				device_name VARCHAR(100),
+				attempts INT NOT NULL DEFAULT 0,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				used_at TIMESTAMP WITH TIME ZONE
+			);
+			CREATE INDEX IF NOT EXISTS idx_login_challenges_expires_at ON login_challenges(expires_at);
+		`,
+	},
+	{
+		Name: "email",
+		SQL: `
+			ALTER TABLE auth ADD COLUMN IF NOT EXISTS email VARCHAR(255);
+			ALTER TABLE auth ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP WITH TIME ZONE;
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_auth_email ON auth(lower(email));
+			CREATE TABLE IF NOT EXISTS email_tokens (
+				id UUID PRIMARY KEY DEFAULT uuidv4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				purpose VARCHAR(16) NOT NULL,
+				email VARCHAR(255) NOT NULL,
+				token_hash VARCHAR(64) UNIQUE NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				used_at TIMESTAMP WITH TIME ZONE
+			);
+			CREATE INDEX IF NOT EXISTS idx_email_tokens_user_id ON email_tokens(user_id, purpose);
+		`,
+	},
+	{
+		Name: "login_throttle",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS login_throttle (
+				key VARCHAR(300) PRIMARY KEY,
+				failures INT NOT NULL DEFAULT 0,
+				last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				locked_until TIMESTAMP WITH TIME ZONE
+			);
+		`,
+	},
+	{
+		Name: "unique_group_names",
+		SQL: `
+			-- Имена, совпадающие без учёта регистра, получают суффикс из id;
+			-- остаётся как есть старейшая группа (и всегда общая).
+			UPDATE groups g
+			SET name = left(g.name, 40) || ' #' || left(g.id::text, 8)
+			FROM (
+				SELECT id, row_number() OVER (
+					PARTITION BY lower(name)
+					ORDER BY id = '00000000-0000-0000-0000-000000000000' DESC, created_at, id
+				) AS n
+				FROM groups
+			) d
+			WHERE d.id = g.id AND d.n > 1;
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_groups_name ON groups(lower(name));
+		`,
+	},
+	{
+		Name: "roles",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS roles (
+				name VARCHAR(50) PRIMARY KEY,
+				description TEXT NOT NULL DEFAULT '',
+				requires_2fa BOOLEAN NOT NULL DEFAULT FALSE,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE TABLE IF NOT EXISTS role_permissions (
+				role VARCHAR(50) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+				permission VARCHAR(100) NOT NULL,
+				PRIMARY KEY (role, permission)
+			);
+			CREATE TABLE IF NOT EXISTS user_roles (
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				role VARCHAR(50) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+				granted_by UUID REFERENCES users(id) ON DELETE SET NULL,
+				granted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (user_id, role)
+			);
+			CREATE INDEX IF NOT EXISTS idx_user_roles_role ON user_roles(role);
+
+			INSERT INTO roles (name, description, requires_2fa) VALUES
+				('admin', 'Администратор', TRUE),
+				('moderator', 'Модератор', FALSE),
+				('user', 'Пользователь', FALSE)
+			ON CONFLICT (name) DO NOTHING;
+
+			INSERT INTO role_permissions (role, permission) VALUES
+				('admin', 'users:list'),
+				('admin', 'users:delete'),
+				('admin', 'roles:manage'),
+				('admin', 'groups:manage'),
+				('admin', 'accounts:unlock'),
+				('moderator', 'users:list'),
+				('moderator', 'accounts:unlock')
+			ON CONFLICT DO NOTHING;
+
+			INSERT INTO user_roles (user_id, role)
+			SELECT id, 'user' FROM users
+			ON CONFLICT DO NOTHING;
+		`,
+	},
+	{
+		Name: "user_directory",
+		SQL: `
+			CREATE EXTENSION IF NOT EXISTS pg_trgm;
+			CREATE INDEX IF NOT EXISTS idx_users_username_trgm ON users USING gin (username gin_trgm_ops);
+			CREATE INDEX IF NOT EXISTS idx_users_username_prefix ON users (lower(username) text_pattern_ops);
+			CREATE INDEX IF NOT EXISTS idx_users_created_at_id ON users (created_at DESC, id DESC);
+		`,
+	},
+	{
+		Name: "profiles",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS profiles (
+				user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+				display_name VARCHAR(100),
+				avatar TEXT,
+				bio VARCHAR(500),
+				locale VARCHAR(35),
+				time_zone VARCHAR(64),
+				last_seen_at TIMESTAMP WITH TIME ZONE,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);
+			INSERT INTO profiles (user_id)
+			SELECT id FROM users
+			ON CONFLICT DO NOTHING;
+		`,
+	},
+	{
+		Name: "username_history",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS username_history (
+				id BIGSERIAL PRIMARY KEY,
+				user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+				username VARCHAR(50) NOT NULL,
+				changed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				reserved_until TIMESTAMP WITH TIME ZONE NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_username_history_username ON username_history(lower(username));
+			CREATE INDEX IF NOT EXISTS idx_username_history_user_id ON username_history(user_id, changed_at DESC);
+		`,
+	},
+	{
+		Name: "outbox",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS outbox (
+				id UUID PRIMARY KEY DEFAULT uuidv4(),
+				seq BIGSERIAL NOT NULL,
+				type VARCHAR(100) NOT NULL,
+				payload JSONB NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				attempts INT NOT NULL DEFAULT 0,
+				next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				last_error TEXT,
+				delivered_at TIMESTAMP WITH TIME ZONE
+			);
+			CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(seq) WHERE delivered_at IS NULL;
+		`,
+	},
+	{
+		Name: "audit_events",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS audit_events (
+				id BIGSERIAL PRIMARY KEY,
+				occurred_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				actor_id UUID,
+				action VARCHAR(100) NOT NULL,
+				target TEXT,
+				ip VARCHAR(45),
+				user_agent TEXT,
+				result VARCHAR(20) NOT NULL,
+				metadata JSONB NOT NULL DEFAULT '{}'
+			);
+			CREATE INDEX IF NOT EXISTS idx_audit_events_actor ON audit_events(actor_id, id DESC);
+			CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events(action, id DESC);
+			CREATE INDEX IF NOT EXISTS idx_audit_events_target ON audit_events(target, id DESC);
+			CREATE INDEX IF NOT EXISTS idx_audit_events_occurred_at ON audit_events(occurred_at);
+
+			-- Журнал только дополняется: правка и удаление запрещены на уровне БД.
+			CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+			BEGIN
+				RAISE EXCEPTION 'audit_events is append-only';
+			END;
+			$$ LANGUAGE plpgsql;
+			DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+			CREATE TRIGGER audit_events_append_only
+				BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+				FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+
+			INSERT INTO role_permissions (role, permission) VALUES
+				('admin', 'audit:read')
+			ON CONFLICT DO NOTHING;
+		`,
+	},
+	{
+		Name: "api_keys",
+		SQL: `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS is_service BOOLEAN NOT NULL DEFAULT FALSE;
+			CREATE TABLE IF NOT EXISTS api_keys (
+				id UUID PRIMARY KEY DEFAULT uuidv4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				name VARCHAR(100) NOT NULL,
+				prefix VARCHAR(16) NOT NULL,
+				key_hash VARCHAR(64) UNIQUE NOT NULL,
+				scopes TEXT[] NOT NULL,
+				created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				expires_at TIMESTAMP WITH TIME ZONE,
+				last_used_at TIMESTAMP WITH TIME ZONE,
+				last_used_ip VARCHAR(45),
+				revoked_at TIMESTAMP WITH TIME ZONE
+			);
+			CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys(user_id);
+
+			INSERT INTO role_permissions (role, permission) VALUES
+				('admin', 'service_accounts:manage')
+			ON CONFLICT DO NOTHING;
+		`,
+	},
+	{
+		// Пароли, ещё не пересчитанные при входе, помечаются явно:
+		// без метки нераспознанное значение в auth.password не принимается.
+		Name: "legacy_password_marker",
+		SQL: `
+			ALTER TABLE auth ALTER COLUMN password TYPE TEXT;
+			UPDATE auth
+			SET password = '$plain$' || password
+			WHERE password NOT LIKE '$argon2id$%'
+			  AND password NOT LIKE '$2a$%'
+			  AND password NOT LIKE '$2b$%'
+			  AND password NOT LIKE '$2y$%'
+			  AND password NOT LIKE '$plain$%';
+		`,
+	},
+	{
+		Name: "signing_key_activation",
+		SQL: `
+			ALTER TABLE signing_keys ADD COLUMN IF NOT EXISTS active_from TIMESTAMP WITH TIME ZONE;
+			UPDATE signing_keys SET active_from = created_at WHERE active_from IS NULL;
+			ALTER TABLE signing_keys ALTER COLUMN active_from SET NOT NULL;
+		`,
+	},
+	{
+		// Журнал называет пользователей только по id. Уже записанные логины,
+		// почты и имена вычищаются единственный раз в обход запрета правок.
+		Name: "audit_events_redact_identifiers",
+		SQL: `
+			ALTER TABLE audit_events DISABLE TRIGGER audit_events_append_only;
+			UPDATE audit_events
+			SET metadata = metadata - ARRAY['login', 'email', 'username',
+			                                'old_login', 'new_login', 'old_username', 'new_username']
+			WHERE metadata ?| ARRAY['login', 'email', 'username',
+			                        'old_login', 'new_login', 'old_username', 'new_username'];
+			UPDATE audit_events
+			SET target = (SELECT user_id::text FROM auth WHERE login = audit_events.target)
+			WHERE action = 'account.unlock';
+			ALTER TABLE audit_events ENABLE TRIGGER audit_events_append_only;
+		`,
+	},
+	{
+		// users:read ничего не открывал: ни один маршрут не принимает по нему ключи.
+		Name: "api_keys_drop_users_read",
+		SQL: `
+			UPDATE api_keys SET scopes = array_remove(scopes, 'users:read')
+			WHERE 'users:read' = ANY(scopes);
+		`,
+	},
+	{
+		// Неподтверждённый адрес не должен мешать настоящему владельцу:
+		// уникальны только подтверждённые, а подтверждение снимает чужие
+		// заявки на тот же адрес.
+		Name: "email_unique_verified",
+		SQL: `
+			DROP INDEX IF EXISTS idx_auth_email;
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_auth_email ON auth(lower(email)) WHERE email_verified_at IS NOT NULL;
+			CREATE INDEX IF NOT EXISTS idx_auth_email_lookup ON auth(lower(email));
+		`,
+	},
+	{
+		// Прежние коды хранились как SHA-256 без ключа; новые — HMAC.
+		Name: "recovery_codes_keyed",
+		SQL: `
+			ALTER TABLE recovery_codes ADD COLUMN IF NOT EXISTS keyed BOOLEAN NOT NULL DEFAULT FALSE;
+			ALTER TABLE recovery_codes ALTER COLUMN keyed SET DEFAULT TRUE;
+		`,
+	},
+	{
+		// Прежние ключи хранились открытым PKCS8; Rotate шифрует их при запуске.
+		Name: "signing_keys_encrypted",
+		SQL: `
+			ALTER TABLE signing_keys ADD COLUMN IF NOT EXISTS encrypted BOOLEAN NOT NULL DEFAULT FALSE;
+		`,
+	},
 }
 
 func (db *Database) RunMigrations(ctx context.Context) error {
@@ -102,3 +481,58 @@ func (db *Database) RunMigrations(ctx context.Context) error {
 	log.Println("All migrations applied successfully")
 	return nil
 }
+
+type MigrationStatus struct {
+	Name      string
+	AppliedAt *time.Time
+}
+
+// MigrationStatus сообщает, какие миграции уже применены. Миграции,
+// которых нет в коде, но которые записаны в базе, тоже попадают в список.
+func (db *Database) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	var tableExists bool
+	err := db.Pool.QueryRow(ctx, "SELECT to_regclass('migrations') IS NOT NULL").Scan(&tableExists)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check migrations table: %w", err)
+	}
+
+	applied := make(map[string]time.Time)
+	var order []string
+	if tableExists {
+		rows, err := db.Pool.Query(ctx, "SELECT name, applied_at FROM migrations ORDER BY id")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migrations: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			var at time.Time
+			if err := rows.Scan(&name, &at); err != nil {
+				return nil, fmt.Errorf("failed to read migrations: %w", err)
+			}
+			applied[name] = at
+			order = append(order, name)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read migrations: %w", err)
+		}
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	known := make(map[string]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Name] = true
+		s := MigrationStatus{Name: m.Name}
+		if at, ok := applied[m.Name]; ok {
+			s.AppliedAt = &at
+		}
+		status = append(status, s)
+	}
+	for _, name := range order {
+		if !known[name] {
+			at := applied[name]
+			status = append(status, MigrationStatus{Name: name, AppliedAt: &at})
+		}
+	}
+	return status, nil
+}
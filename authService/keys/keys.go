@@ -0,0 +1,395 @@
+package keys
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"authService/db"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+)
+
+// rotationLockID — ключ advisory-блокировки, чтобы несколько реплик
+// не сгенерировали новый ключ одновременно.
+const rotationLockID = 0x6b657973
+
+type Key struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	CreatedAt time.Time
+	// ActiveFrom — с этого момента ключом подписывают. Следующий ключ
+	// создаётся заранее, чтобы к началу подписи он уже был в JWKS.
+	ActiveFrom time.Time
+	// RetiresAt — после этого момента ключом больше не подписывают.
+	RetiresAt time.Time
+	// ExpiresAt — после этого момента ключ убирается из JWKS.
+	ExpiresAt time.Time
+}
+
+func (k *Key) Method() jwt.SigningMethod {
+	if k.Algorithm == AlgorithmRS256 {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+func (k *Key) Public() crypto.PublicKey {
+	return k.Private.Public()
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+func (k *Key) JWK() JWK {
+	jwk := JWK{Kid: k.ID, Use: "sig", Alg: k.Algorithm}
+	switch pub := k.Public().(type) {
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	}
+	return jwk
+}
+
+// Manager хранит ключи подписи в базе и ротирует их по расписанию.
+// Новый ключ публикуется за overlap до начала подписи, чтобы все
+// реплики и кеши JWKS успели его получить, а старый — ещё overlap
+// после ротации, чтобы выданные им токены успели истечь.
+// Закрытые ключи лежат в базе зашифрованными AES-256-GCM на ключе kek,
+// который в базу не попадает: копии базы не хватит, чтобы подделать токен.
+type Manager struct {
+	db          *db.Database
+	algorithm   string
+	rotateEvery time.Duration
+	overlap     time.Duration
+	kek         cipher.AEAD
+
+	mu   sync.RWMutex
+	keys []*Key
+}
+
+func NewManager(database *db.Database, algorithm string, rotateEvery, overlap time.Duration, kek []byte) (*Manager, error) {
+	if algorithm != AlgorithmEdDSA && algorithm != AlgorithmRS256 {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if rotateEvery <= 0 || overlap <= 0 {
+		return nil, fmt.Errorf("key rotation interval and overlap must be positive")
+	}
+	if len(kek) != 32 {
+		return nil, fmt.Errorf("key encryption key must be 32 bytes, got %d", len(kek))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init key encryption: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init key encryption: %w", err)
+	}
+	return &Manager{
+		db:          database,
+		algorithm:   algorithm,
+		rotateEvery: rotateEvery,
+		overlap:     overlap,
+		kek:         aead,
+	}, nil
+}
+
+// seal шифрует закрытый ключ; kid входит в проверяемые данные, чтобы
+// зашифрованный ключ нельзя было подставить в чужую строку.
+func (m *Manager) seal(kid string, der []byte) ([]byte, error) {
+	nonce := make([]byte, m.kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return m.kek.Seal(nonce, nonce, der, []byte(kid)), nil
+}
+
+func (m *Manager) open(kid string, sealed []byte) ([]byte, error) {
+	if len(sealed) < m.kek.NonceSize() {
+		return nil, fmt.Errorf("sealed key too short")
+	}
+	nonce, ciphertext := sealed[:m.kek.NonceSize()], sealed[m.kek.NonceSize():]
+	return m.kek.Open(nil, nonce, ciphertext, []byte(kid))
+}
+
+// encryptLegacy шифрует ключи, сохранённые до появления kek.
+func (m *Manager) encryptLegacy(ctx context.Context, tx pgx.Tx) error {
+	rows, err := tx.Query(ctx, "SELECT kid, private_key FROM signing_keys WHERE NOT encrypted")
+	if err != nil {
+		return fmt.Errorf("failed to find unencrypted signing keys: %w", err)
+	}
+	type plain struct {
+		kid string
+		der []byte
+	}
+	var legacy []plain
+	for rows.Next() {
+		var p plain
+		if err := rows.Scan(&p.kid, &p.der); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan signing key: %w", err)
+		}
+		legacy = append(legacy, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read signing keys: %w", err)
+	}
+
+	for _, p := range legacy {
+		sealed, err := m.seal(p.kid, p.der)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx,
+			"UPDATE signing_keys SET private_key = $2, encrypted = TRUE WHERE kid = $1",
+			p.kid, sealed,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt signing key %s: %w", p.kid, err)
+		}
+		log.Printf("Encrypted signing key %s", p.kid)
+	}
+	return nil
+}
+
+// Rotate создаёт следующий ключ, когда до конца подписи последним
+// ключом остаётся меньше overlap, и перечитывает набор ключей из базы.
+func (m *Manager) Rotate(ctx context.Context) error {
+	tx, err := m.db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin key rotation: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", rotationLockID); err != nil {
+		return fmt.Errorf("failed to lock signing keys: %w", err)
+	}
+	if err := m.encryptLegacy(ctx, tx); err != nil {
+		return err
+	}
+
+	var lastRetires *time.Time
+	err = tx.QueryRow(ctx,
+		"SELECT max(retires_at) FROM signing_keys WHERE algorithm = $1",
+		m.algorithm,
+	).Scan(&lastRetires)
+	if err != nil {
+		return fmt.Errorf("failed to check signing keys: %w", err)
+	}
+
+	now := time.Now()
+	activeFrom := now
+	if lastRetires != nil && lastRetires.After(now) {
+		activeFrom = *lastRetires
+	}
+	// Не больше одного ключа в очереди, даже если overlap длиннее периода ротации.
+	if activeFrom.Sub(now) <= min(m.overlap, m.rotateEvery) {
+		key, err := m.generate(now, activeFrom)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+		if err != nil {
+			return fmt.Errorf("failed to encode signing key: %w", err)
+		}
+		sealed, err := m.seal(key.ID, der)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx,
+			`INSERT INTO signing_keys (kid, algorithm, private_key, encrypted, created_at, active_from, retires_at, expires_at)
+			 VALUES ($1, $2, $3, TRUE, $4, $5, $6, $7)`,
+			key.ID, key.Algorithm, sealed, key.CreatedAt, key.ActiveFrom, key.RetiresAt, key.ExpiresAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to store signing key: %w", err)
+		}
+		log.Printf("Generated signing key %s (%s), active from %s", key.ID, key.Algorithm, key.ActiveFrom.Format(time.RFC3339))
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM signing_keys WHERE expires_at < CURRENT_TIMESTAMP"); err != nil {
+		return fmt.Errorf("failed to delete expired signing keys: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit key rotation: %w", err)
+	}
+	return m.load(ctx)
+}
+
+// Run периодически вызывает Rotate, пока не отменён ctx.
+func (m *Manager) Run(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Rotate(ctx); err != nil {
+				log.Printf("Signing key rotation failed: %v", err)
+			}
+		}
+	}
+}
+
+// Signing возвращает ключ, которым подписывают сейчас. Если уже
+// действуют два ключа, выбирается тот, что начал действовать позже.
+func (m *Manager) Signing() (*Key, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	var signing *Key
+	for _, k := range m.keys {
+		if k.Algorithm != m.algorithm || now.Before(k.ActiveFrom) || !now.Before(k.RetiresAt) {
+			continue
+		}
+		if signing == nil || k.ActiveFrom.After(signing.ActiveFrom) {
+			signing = k
+		}
+	}
+	if signing == nil {
+		return nil, fmt.Errorf("no active signing key")
+	}
+	return signing, nil
+}
+
+func (m *Manager) Lookup(kid string) (*Key, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	for _, k := range m.keys {
+		if k.ID == kid && now.Before(k.ExpiresAt) {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+func (m *Manager) JWKS() []JWK {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	set := make([]JWK, 0, len(m.keys))
+	for _, k := range m.keys {
+		if now.Before(k.ExpiresAt) {
+			set = append(set, k.JWK())
+		}
+	}
+	return set
+}
+
+// Load перечитывает ключи из базы без ротации. Нужен там, где ключи
+// только проверяются, например в командах администратора.
+func (m *Manager) Load(ctx context.Context) error {
+	return m.load(ctx)
+}
+
+func (m *Manager) load(ctx context.Context) error {
+	rows, err := m.db.Pool.Query(ctx,
+		`SELECT kid, algorithm, private_key, encrypted, created_at, active_from, retires_at, expires_at
+		 FROM signing_keys
+		 WHERE expires_at > CURRENT_TIMESTAMP
+		 ORDER BY created_at DESC`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to load signing keys: %w", err)
+	}
+	defer rows.Close()
+
+	var loaded []*Key
+	for rows.Next() {
+		var k Key
+		var der []byte
+		var encrypted bool
+		if err := rows.Scan(&k.ID, &k.Algorithm, &der, &encrypted, &k.CreatedAt, &k.ActiveFrom, &k.RetiresAt, &k.ExpiresAt); err != nil {
+			return fmt.Errorf("failed to scan signing key: %w", err)
+		}
+		if encrypted {
+			var err error
+			if der, err = m.open(k.ID, der); err != nil {
+				return fmt.Errorf("failed to decrypt signing key %s, check SIGNING_KEY_KEK: %w", k.ID, err)
+			}
+		}
+		priv, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return fmt.Errorf("failed to parse signing key %s: %w", k.ID, err)
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("signing key %s is not a signer", k.ID)
+		}
+		k.Private = signer
+		loaded = append(loaded, &k)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read signing keys: %w", err)
+	}
+
+	m.mu.Lock()
+	m.keys = loaded
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Manager) generate(now, activeFrom time.Time) (*Key, error) {
+	var signer crypto.Signer
+	switch m.algorithm {
+	case AlgorithmRS256:
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate RSA key: %w", err)
+		}
+		signer = priv
+	default:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate Ed25519 key: %w", err)
+		}
+		signer = priv
+	}
+
+	return &Key{
+		ID:         uuid.NewString(),
+		Algorithm:  m.algorithm,
+		Private:    signer,
+		CreatedAt:  now,
+		ActiveFrom: activeFrom,
+		RetiresAt:  activeFrom.Add(m.rotateEvery),
+		ExpiresAt:  activeFrom.Add(m.rotateEvery + m.overlap),
+	}, nil
+}
@@ -2,20 +2,45 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
+	_ "time/tzdata"
 
 	"authService/db"
+	"authService/keys"
+	"authService/mail"
+	"authService/outbox"
+	"authService/password"
 	"authService/server"
+	"eventBus/bus"
 )
 
 func main() {
-	jwtSecret := "super-secret-pass"
-	connStr := os.Getenv("POSTGRES_URL")
+	// Без аргументов запускается сервер, как и раньше.
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	if err := run(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func serve() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
-	database, err := db.New(ctx, connStr)
+	database, err := openDatabase(ctx)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
@@ -25,11 +50,238 @@ func main() {
 	}
 
 	log.Println("Database migrations completed successfully")
-	srv := server.New(database, jwtSecret)
+	hasher, err := password.NewHasher(passwordParams())
+	if err != nil {
+		log.Fatalf("Failed to configure password hashing: %v", err)
+	}
+	policy, err := passwordPolicy()
+	if err != nil {
+		log.Fatalf("Failed to configure password policy: %v", err)
+	}
+	accessTTL := envDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+	keyManager, err := newKeyManager(database, accessTTL)
+	if err != nil {
+		log.Fatalf("Failed to configure signing keys: %v", err)
+	}
+	if err := keyManager.Rotate(ctx); err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+	go keyManager.Run(context.Background(), time.Minute)
+
+	recoveryKey, err := envKey("RECOVERY_CODE_KEY")
+	if err != nil {
+		log.Fatalf("Failed to configure recovery codes: %v", err)
+	}
+	tokens := server.NewTokenIssuer(keyManager, accessTTL, envDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour))
+	config := server.Config{
+		TOTPIssuer:      envString("TOTP_ISSUER", "4at20"),
+		AppURL:          envString("APP_URL", "http://localhost:3000"),
+		VerifyTokenTTL:  envDuration("EMAIL_VERIFY_TOKEN_TTL", 48*time.Hour),
+		ResetTokenTTL:   envDuration("PASSWORD_RESET_TOKEN_TTL", time.Hour),
+		UsernameHold:    envDuration("USERNAME_HOLD_PERIOD", 30*24*time.Hour),
+		LoginLimits:     loginLimits(),
+		ServiceTokens:   serviceTokens(),
+		PasswordPolicy:  policy,
+		RecoveryCodeKey: recoveryKey,
+	}
+	if login := os.Getenv("BOOTSTRAP_ADMIN_LOGIN"); login != "" {
+		if err := server.BootstrapAdmin(ctx, database, login); err != nil {
+			log.Printf("Failed to bootstrap admin %q: %v", login, err)
+		}
+	}
+	mailer, err := newMailer()
+	if err != nil {
+		log.Fatalf("Failed to configure mailer: %v", err)
+	}
+	eventBus, err := newBus(ctx)
+	if err != nil {
+		log.Fatalf("Failed to connect to event bus: %v", err)
+	}
+	if eventBus != nil {
+		defer eventBus.Close()
+		relay := outbox.NewRelay(database, eventBus, 100)
+		go relay.Run(context.Background(), envDuration("OUTBOX_POLL_INTERVAL", time.Second))
+	} else {
+		warnPendingOutbox(ctx, database)
+	}
+	srv := server.New(database, tokens, hasher, mailer, config)
 	port := os.Getenv("SERVER_PORT")
 	log.Printf("Auth Service starting on :%s", port)
 	if err := srv.Start(":" + port); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
+}
 
+func openDatabase(ctx context.Context) (*db.Database, error) {
+	return db.New(ctx, os.Getenv("POSTGRES_URL"))
+}
+
+func newKeyManager(database *db.Database, accessTTL time.Duration) (*keys.Manager, error) {
+	keyOverlap := envDuration("SIGNING_KEY_OVERLAP", 24*time.Hour)
+	if keyOverlap < accessTTL {
+		return nil, fmt.Errorf("SIGNING_KEY_OVERLAP (%s) must not be shorter than ACCESS_TOKEN_TTL (%s)", keyOverlap, accessTTL)
+	}
+	kek, err := envKey("SIGNING_KEY_KEK")
+	if err != nil {
+		return nil, err
+	}
+	return keys.NewManager(database, envString("JWT_SIGNING_ALGORITHM", keys.AlgorithmEdDSA),
+		envDuration("SIGNING_KEY_ROTATION", 7*24*time.Hour), keyOverlap, kek)
+}
+
+func passwordParams() password.Params {
+	params := password.DefaultParams()
+	if algo := os.Getenv("PASSWORD_HASH_ALGORITHM"); algo != "" {
+		params.Algorithm = algo
+	}
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_MEMORY_KIB"), 10, 32); err == nil {
+		params.Memory = uint32(v)
+	}
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_ITERATIONS"), 10, 32); err == nil {
+		params.Iterations = uint32(v)
+	}
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_PARALLELISM"), 10, 8); err == nil {
+		params.Parallelism = uint8(v)
+	}
+	if v, err := strconv.Atoi(os.Getenv("BCRYPT_COST")); err == nil {
+		params.BcryptCost = v
+	}
+	return params
+}
+
+// passwordPolicy читает требования к паролям. Из словаря утёкших паролей
+// в BREACHED_PASSWORDS_PATH при старте строится фильтр Блума.
+func passwordPolicy() (password.Policy, error) {
+	policy := password.DefaultPolicy()
+	if v, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && v > 0 {
+		policy.MinLength = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_CLASSES")); err == nil && v >= 0 && v <= 4 {
+		policy.MinClasses = v
+	}
+	if path := os.Getenv("BREACHED_PASSWORDS_PATH"); path != "" {
+		minCount, _ := strconv.Atoi(os.Getenv("BREACHED_PASSWORDS_MIN_COUNT"))
+		breached, err := password.LoadBreached(path, minCount)
+		if err != nil {
+			return password.Policy{}, err
+		}
+		log.Printf("Loaded %d breached password hashes", breached.Len())
+		policy.Breached = breached
+	}
+	return policy, nil
+}
+
+func loginLimits() server.LoginLimits {
+	limits := server.DefaultLoginLimits()
+	if v, err := strconv.Atoi(os.Getenv("LOGIN_MAX_FAILURES")); err == nil && v > 0 {
+		limits.MaxFailuresPerLogin = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("LOGIN_MAX_FAILURES_PER_IP")); err == nil && v > 0 {
+		limits.MaxFailuresPerIP = v
+	}
+	limits.BaseLockout = envDuration("LOGIN_LOCKOUT_BASE", limits.BaseLockout)
+	limits.MaxLockout = envDuration("LOGIN_LOCKOUT_MAX", limits.MaxLockout)
+	limits.Window = envDuration("LOGIN_FAILURE_WINDOW", limits.Window)
+	return limits
+}
+
+// serviceTokens разбирает SERVICE_TOKENS вида "chat=secret,other=secret2".
+func serviceTokens() map[string]string {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv("SERVICE_TOKENS"), ",") {
+		name, token, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || name == "" || token == "" {
+			continue
+		}
+		tokens[name] = token
+	}
+	return tokens
+}
+
+// newBus подключает шину событий. Подписчиков auth внутри процесса нет,
+// поэтому шина в памяти только потеряла бы события, в том числе
+// user.deleted, и EVENT_BUS=inprocess отвергается. Без NATS relay не
+// запускается, и события копятся в outbox до его подключения.
+func newBus(ctx context.Context) (bus.Bus, error) {
+	switch backend := envString("EVENT_BUS", "none"); backend {
+	case "nats":
+		return bus.NewNATS(ctx, envString("NATS_URL", "nats://localhost:4222"), envString("NATS_STREAM", "EVENTS"))
+	case "none":
+		log.Println("No event bus configured, outbox events stay queued until EVENT_BUS=nats")
+		return nil, nil
+	case "inprocess":
+		return nil, errors.New("EVENT_BUS=inprocess is not supported by authService: nothing in this process consumes its events, so user.deleted would never reach chatService; use nats or none")
+	default:
+		return nil, fmt.Errorf("unknown event bus %q", backend)
+	}
+}
+
+// newMailer требует явный MAIL_BACKEND: тихий откат на лог оставил бы
+// пользователей без писем о сбросе пароля.
+// warnPendingOutbox предупреждает, что без relay события, среди них
+// удаления пользователей, так и останутся в outbox.
+func warnPendingOutbox(ctx context.Context, database *db.Database) {
+	pending, err := outbox.Pending(ctx, database)
+	if err != nil {
+		log.Printf("Failed to count pending outbox events: %v", err)
+		return
+	}
+	if pending > 0 {
+		log.Printf("WARNING: %d outbox events are waiting and no relay is running; set EVENT_BUS=nats to deliver them", pending)
+	}
+}
+
+func newMailer() (mail.Mailer, error) {
+	from := envString("MAIL_FROM", "no-reply@4at20.local")
+	switch backend := os.Getenv("MAIL_BACKEND"); backend {
+	case "":
+		return nil, fmt.Errorf("MAIL_BACKEND is required: smtp, file or log")
+	case "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("SMTP_ADDR is required for the smtp mail backend")
+		}
+		return &mail.SMTPMailer{
+			Addr:     addr,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	case "file":
+		return &mail.FileMailer{Dir: envString("MAIL_DIR", "./tmp/mail"), From: from}, nil
+	case "log":
+		return mail.LogMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail backend %q", backend)
+	}
+}
+
+// envKey читает секретный ключ не короче 32 байт в base64.
+func envKey(name string) ([]byte, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil, fmt.Errorf("%s is required", name)
+	}
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not valid base64: %w", name, err)
+	}
+	if len(key) < 32 {
+		return nil, fmt.Errorf("%s must be at least 32 bytes, got %d", name, len(key))
+	}
+	return key, nil
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
 }
@@ -0,0 +1,161 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// falsePositiveRate — доля обычных паролей, которые фильтр ошибочно сочтёт
+// утёкшими. Такой пароль просто придётся сменить на другой.
+const falsePositiveRate = 0.001
+
+// BreachedSet — фильтр Блума по SHA-1 утёкших паролей, построенный при
+// старте. Сам словарь в памяти не держится: при доле ложных срабатываний
+// 0,1% на пароль уходит около 1,8 байта вместо 20. Сеть во время работы
+// не нужна.
+type BreachedSet struct {
+	bits   []uint64
+	size   uint64
+	hashes int
+	count  int
+}
+
+// LoadBreached читает словарь в формате Have I Been Pwned. path может быть
+// файлом со строками "SHA1[:count]" или каталогом, скачанным по диапазонам,
+// где файл 5-символьного префикса ABCDE.txt содержит строки "SUFFIX:count".
+// Строки с count меньше minCount пропускаются. Словарь читается дважды:
+// сначала, чтобы узнать размер фильтра, затем чтобы его заполнить.
+func LoadBreached(path string, minCount int) (*BreachedSet, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password corpus: %w", err)
+	}
+
+	type source struct{ path, prefix string }
+	var sources []source
+	if !info.IsDir() {
+		sources = append(sources, source{path, ""})
+	} else {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read breached password corpus: %w", err)
+		}
+		for _, entry := range entries {
+			prefix := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+			if entry.IsDir() || len(prefix) != 5 {
+				continue
+			}
+			if _, err := hex.DecodeString(prefix + "0"); err != nil {
+				continue
+			}
+			sources = append(sources, source{filepath.Join(path, entry.Name()), prefix})
+		}
+	}
+
+	total := 0
+	for _, src := range sources {
+		err := readBreachedFile(src.path, src.prefix, minCount, func([sha1.Size]byte) { total++ })
+		if err != nil {
+			return nil, err
+		}
+	}
+	set := newBreachedSet(total, falsePositiveRate)
+	for _, src := range sources {
+		if err := readBreachedFile(src.path, src.prefix, minCount, set.add); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// newBreachedSet готовит пустой фильтр на n паролей с заданной долей
+// ложных срабатываний.
+func newBreachedSet(n int, fpRate float64) *BreachedSet {
+	n = max(n, 1)
+	size := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	size = (size + 63) &^ 63
+	hashes := max(1, int(math.Round(float64(size)/float64(n)*math.Ln2)))
+	return &BreachedSet{bits: make([]uint64, size/64), size: size, hashes: hashes}
+}
+
+// positions выдаёт номера битов двойным хешированием: SHA-1 уже равномерна,
+// так что её первые 16 байт служат двумя независимыми хешами.
+func (s *BreachedSet) positions(sum [sha1.Size]byte, visit func(bit uint64) bool) bool {
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16]) | 1
+	for i := range s.hashes {
+		if !visit((h1 + uint64(i)*h2) % s.size) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *BreachedSet) add(sum [sha1.Size]byte) {
+	s.positions(sum, func(bit uint64) bool {
+		s.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+	s.count++
+}
+
+func readBreachedFile(path, prefix string, minCount int, add func([sha1.Size]byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open breached password corpus: %w", err)
+	}
+	defer f.Close()
+	if err := readBreached(f, prefix, minCount, add); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func readBreached(r io.Reader, prefix string, minCount int, add func([sha1.Size]byte)) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, countText, hasCount := strings.Cut(text, ":")
+		if hasCount && minCount > 1 {
+			var count int
+			if _, err := fmt.Sscan(countText, &count); err == nil && count < minCount {
+				continue
+			}
+		}
+
+		var sum [sha1.Size]byte
+		decoded, err := hex.DecodeString(prefix + hash)
+		if err != nil || len(decoded) != sha1.Size {
+			return fmt.Errorf("malformed hash on line %d", line)
+		}
+		copy(sum[:], decoded)
+		add(sum)
+	}
+	return scanner.Err()
+}
+
+// Len — сколько хешей занесено в фильтр, повторы считаются каждый раз.
+func (s *BreachedSet) Len() int {
+	return s.count
+}
+
+// Contains не ошибается для утёкших паролей, а для остальных отвечает
+// true с вероятностью falsePositiveRate.
+func (s *BreachedSet) Contains(password string) bool {
+	return s.positions(sha1.Sum([]byte(password)), func(bit uint64) bool {
+		return s.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
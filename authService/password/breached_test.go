@@ -0,0 +1,131 @@
+package password
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sha1Sum(password string) [sha1.Size]byte {
+	return sha1.Sum([]byte(password))
+}
+
+func sha1Hex(password string) string {
+	sum := sha1Sum(password)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadBreachedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	writeFile(t, path, strings.Join([]string{
+		"# comment",
+		sha1Hex("qwerty") + ":100",
+		"",
+		strings.ToLower(sha1Hex("letmein")),
+		sha1Hex("rare") + ":1",
+	}, "\n"))
+
+	tests := []struct {
+		minCount int
+		present  []string
+		absent   []string
+	}{
+		{0, []string{"qwerty", "letmein", "rare"}, []string{"not in corpus"}},
+		// Строка без счётчика не отсеивается порогом.
+		{10, []string{"qwerty", "letmein"}, []string{"rare"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("min %d", tt.minCount), func(t *testing.T) {
+			set, err := LoadBreached(path, tt.minCount)
+			if err != nil {
+				t.Fatalf("LoadBreached: %v", err)
+			}
+			if set.Len() != len(tt.present) {
+				t.Errorf("Len = %d, want %d", set.Len(), len(tt.present))
+			}
+			for _, pw := range tt.present {
+				if !set.Contains(pw) {
+					t.Errorf("Contains(%q) = false", pw)
+				}
+			}
+			for _, pw := range tt.absent {
+				if set.Contains(pw) {
+					t.Errorf("Contains(%q) = true", pw)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadBreachedRangeDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for _, pw := range []string{"dragon", "monkey"} {
+		h := sha1Hex(pw)
+		writeFile(t, filepath.Join(dir, h[:5]+".txt"), h[5:]+":42\n")
+	}
+	writeFile(t, filepath.Join(dir, "README.txt"), "not a range file")
+	writeFile(t, filepath.Join(dir, "ZZZZZ.txt"), "not hex either")
+
+	set, err := LoadBreached(dir, 0)
+	if err != nil {
+		t.Fatalf("LoadBreached: %v", err)
+	}
+	if set.Len() != 2 || !set.Contains("dragon") || !set.Contains("monkey") || set.Contains("dragon2") {
+		t.Errorf("unexpected set: len %d", set.Len())
+	}
+}
+
+func TestLoadBreachedErrors(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.txt")
+	writeFile(t, bad, sha1Hex("ok")+"\nnot-a-hash\n")
+
+	if _, err := LoadBreached(bad, 0); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("LoadBreached(malformed) = %v, want error on line 2", err)
+	}
+	if _, err := LoadBreached(filepath.Join(dir, "missing"), 0); err == nil {
+		t.Error("LoadBreached(missing) succeeded")
+	}
+}
+
+func TestBreachedSetFalsePositiveRate(t *testing.T) {
+	const n = 20000
+	set := newBreachedSet(n, falsePositiveRate)
+	for i := range n {
+		set.add(sha1Sum(fmt.Sprintf("breached-%d", i)))
+	}
+	for i := range n {
+		if !set.Contains(fmt.Sprintf("breached-%d", i)) {
+			t.Fatalf("breached-%d missing, bloom filter must not have false negatives", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := range n {
+		if set.Contains(fmt.Sprintf("fresh-%d", i)) {
+			falsePositives++
+		}
+	}
+	// Ожидается около 20 срабатываний; запас в пять раз убирает случайные падения.
+	if rate := float64(falsePositives) / n; rate > 5*falsePositiveRate {
+		t.Errorf("false positive rate %.4f, want about %.4f", rate, falsePositiveRate)
+	}
+}
+
+func TestEmptyBreachedSet(t *testing.T) {
+	set := newBreachedSet(0, falsePositiveRate)
+	if set.Len() != 0 || set.Contains("anything") {
+		t.Error("empty set reports a match")
+	}
+}
@@ -0,0 +1,209 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+// LegacyPrefix помечает пароли, сохранённые открытым текстом до
+// появления хеширования. Префикс ставит одноразовая миграция, поэтому
+// любое другое нераспознанное значение считается повреждённым хешем.
+const LegacyPrefix = "$plain$"
+
+var ErrInvalidHash = errors.New("invalid password hash format")
+
+// Params описывает алгоритм и стоимость хеширования, с которыми
+// создаются новые хеши. Хеши со слабее заданными параметрами
+// считаются устаревшими и пересчитываются при следующем входе.
+type Params struct {
+	Algorithm string
+
+	// argon2id
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+
+	// bcrypt
+	BcryptCost int
+}
+
+func DefaultParams() Params {
+	return Params{
+		Algorithm:   AlgorithmArgon2id,
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 2,
+		SaltLength:  16,
+		KeyLength:   32,
+		BcryptCost:  12,
+	}
+}
+
+type Hasher struct {
+	params Params
+
+	dummyOnce sync.Once
+	dummy     string
+}
+
+func NewHasher(params Params) (*Hasher, error) {
+	switch params.Algorithm {
+	case AlgorithmArgon2id:
+		if params.Memory == 0 || params.Iterations == 0 || params.Parallelism == 0 ||
+			params.SaltLength == 0 || params.KeyLength == 0 {
+			return nil, fmt.Errorf("argon2id parameters must be positive")
+		}
+	case AlgorithmBcrypt:
+		if params.BcryptCost < bcrypt.MinCost || params.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q", params.Algorithm)
+	}
+	return &Hasher{params: params}, nil
+}
+
+// Hash возвращает самоописывающую строку: PHC-формат для argon2id
+// ($argon2id$v=19$m=...,t=...,p=...$salt$hash) или стандартный
+// модульный формат bcrypt ($2a$cost$...).
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.params.Algorithm == AlgorithmBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.params.BcryptCost)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %w", err)
+		}
+		return string(hash), nil
+	}
+
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt,
+		h.params.Iterations, h.params.Memory, h.params.Parallelism, h.params.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.params.Memory, h.params.Iterations, h.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify сравнивает пароль с сохранённым значением за постоянное время.
+// needsRehash сообщает, что значение нужно пересчитать текущими
+// параметрами: это открытый текст из старых записей, другой алгоритм
+// или более слабые параметры. Значение неизвестного формата не
+// принимается ни с каким паролем.
+func (h *Hasher) Verify(password, stored string) (ok bool, needsRehash bool, err error) {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		p, salt, key, err := decodeArgon2id(stored)
+		if err != nil {
+			return false, false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return false, false, nil
+		}
+		return true, h.argon2idWeaker(p, uint32(len(salt)), uint32(len(key))), nil
+
+	case isBcrypt(stored):
+		err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, fmt.Errorf("%w: %v", ErrInvalidHash, err)
+		}
+		if h.params.Algorithm != AlgorithmBcrypt {
+			return true, true, nil
+		}
+		cost, err := bcrypt.Cost([]byte(stored))
+		if err != nil {
+			return true, true, nil
+		}
+		return true, cost < h.params.BcryptCost, nil
+
+	case strings.HasPrefix(stored, LegacyPrefix):
+		plain := strings.TrimPrefix(stored, LegacyPrefix)
+		if subtle.ConstantTimeCompare([]byte(plain), []byte(password)) != 1 {
+			return false, false, nil
+		}
+		return true, true, nil
+
+	default:
+		return false, false, ErrInvalidHash
+	}
+}
+
+// VerifyDummy тратит на проверку столько же времени, сколько Verify
+// для существующей учётной записи. Вызывается, когда логин не найден,
+// чтобы по времени ответа нельзя было отличить существующие логины.
+func (h *Hasher) VerifyDummy(password string) {
+	h.dummyOnce.Do(func() {
+		h.dummy, _ = h.Hash("dummy-password")
+	})
+	_, _, _ = h.Verify(password, h.dummy)
+}
+
+func (h *Hasher) argon2idWeaker(p Params, saltLen, keyLen uint32) bool {
+	if h.params.Algorithm != AlgorithmArgon2id {
+		return true
+	}
+	return p.Memory < h.params.Memory ||
+		p.Iterations < h.params.Iterations ||
+		p.Parallelism < h.params.Parallelism ||
+		saltLen < h.params.SaltLength ||
+		keyLen < h.params.KeyLength
+}
+
+func isBcrypt(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+func decodeArgon2id(stored string) (Params, []byte, []byte, error) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	if version != argon2.Version {
+		return Params{}, nil, nil, fmt.Errorf("%w: unsupported argon2 version %d", ErrInvalidHash, version)
+	}
+
+	p := Params{Algorithm: AlgorithmArgon2id}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	return p, salt, key, nil
+}
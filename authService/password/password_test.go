@@ -0,0 +1,144 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Параметры поменьше, чтобы тесты не тратили по 64 МиБ на хеш.
+func testParams() Params {
+	p := DefaultParams()
+	p.Memory = 1024
+	p.Iterations = 1
+	p.Parallelism = 1
+	p.BcryptCost = 4
+	return p
+}
+
+func mustHasher(t *testing.T, p Params) *Hasher {
+	t.Helper()
+	h, err := NewHasher(p)
+	if err != nil {
+		t.Fatalf("NewHasher: %v", err)
+	}
+	return h
+}
+
+func mustHash(t *testing.T, h *Hasher, pw string) string {
+	t.Helper()
+	hash, err := h.Hash(pw)
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	return hash
+}
+
+func TestHashFormat(t *testing.T) {
+	argon := testParams()
+	bcryptParams := testParams()
+	bcryptParams.Algorithm = AlgorithmBcrypt
+
+	tests := []struct {
+		name   string
+		params Params
+		prefix string
+	}{
+		{"argon2id", argon, "$argon2id$v=19$m=1024,t=1,p=1$"},
+		{"bcrypt", bcryptParams, "$2a$04$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := mustHasher(t, tt.params)
+			a := mustHash(t, h, "secret")
+			b := mustHash(t, h, "secret")
+			if !strings.HasPrefix(a, tt.prefix) {
+				t.Errorf("hash %q does not start with %q", a, tt.prefix)
+			}
+			if a == b {
+				t.Error("two hashes of the same password are equal, salt is not random")
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	current := mustHasher(t, testParams())
+
+	weaker := testParams()
+	weaker.Memory = 512
+	bcryptParams := testParams()
+	bcryptParams.Algorithm = AlgorithmBcrypt
+
+	argonHash := mustHash(t, current, "secret")
+	weakHash := mustHash(t, mustHasher(t, weaker), "secret")
+	bcryptHash := mustHash(t, mustHasher(t, bcryptParams), "secret")
+
+	tests := []struct {
+		name        string
+		password    string
+		stored      string
+		ok          bool
+		needsRehash bool
+		err         error
+	}{
+		{"argon2id match", "secret", argonHash, true, false, nil},
+		{"argon2id mismatch", "Secret", argonHash, false, false, nil},
+		{"weaker argon2id", "secret", weakHash, true, true, nil},
+		{"bcrypt match", "secret", bcryptHash, true, true, nil},
+		{"bcrypt mismatch", "other", bcryptHash, false, false, nil},
+		{"legacy match", "secret", LegacyPrefix + "secret", true, true, nil},
+		{"legacy mismatch", "secret2", LegacyPrefix + "secret", false, false, nil},
+		{"unmarked plaintext", "secret", "secret", false, false, ErrInvalidHash},
+		{"hash as password", argonHash, argonHash, false, false, nil},
+		{"truncated argon2id", "secret", argonHash[:len(argonHash)-50], false, false, ErrInvalidHash},
+		{"unknown format", "x", "$scrypt$x", false, false, ErrInvalidHash},
+		{"empty", "", "", false, false, ErrInvalidHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, needsRehash, err := current.Verify(tt.password, tt.stored)
+			if ok != tt.ok || needsRehash != tt.needsRehash {
+				t.Errorf("Verify = (%v, %v), want (%v, %v)", ok, needsRehash, tt.ok, tt.needsRehash)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Verify error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyBcryptCost(t *testing.T) {
+	p := testParams()
+	p.Algorithm = AlgorithmBcrypt
+	cheap := mustHash(t, mustHasher(t, p), "secret")
+
+	p.BcryptCost = 5
+	h := mustHasher(t, p)
+	if ok, needsRehash, err := h.Verify("secret", cheap); !ok || !needsRehash || err != nil {
+		t.Errorf("Verify = (%v, %v, %v), want rehash of cheaper bcrypt hash", ok, needsRehash, err)
+	}
+	if ok, needsRehash, err := h.Verify("secret", mustHash(t, h, "secret")); !ok || needsRehash || err != nil {
+		t.Errorf("Verify = (%v, %v, %v), want match without rehash", ok, needsRehash, err)
+	}
+}
+
+func TestNewHasherRejectsBadParams(t *testing.T) {
+	zeroMemory := testParams()
+	zeroMemory.Memory = 0
+	badCost := testParams()
+	badCost.Algorithm = AlgorithmBcrypt
+	badCost.BcryptCost = 1
+	unknown := testParams()
+	unknown.Algorithm = "md5"
+
+	for name, p := range map[string]Params{
+		"zero memory": zeroMemory,
+		"bcrypt cost": badCost,
+		"unknown":     unknown,
+	} {
+		if _, err := NewHasher(p); err == nil {
+			t.Errorf("%s: NewHasher succeeded", name)
+		}
+	}
+}
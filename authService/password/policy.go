@@ -0,0 +1,124 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Правила политики паролей. Коды стабильны и возвращаются клиенту,
+// чтобы он мог подсветить конкретное требование.
+const (
+	RuleMinLength  = "min_length"
+	RuleMaxLength  = "max_length"
+	RuleClasses    = "character_classes"
+	RuleIdentifier = "contains_identifier"
+	RuleBreached   = "breached"
+	RuleWhitespace = "whitespace_only"
+)
+
+const (
+	// minIdentifier — идентификаторы короче не проверяются, иначе
+	// имя «ab» запретило бы слишком много паролей.
+	minIdentifier   = 3
+	maxPasswordSize = 255
+)
+
+// Violation — одно нарушенное правило.
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PolicyError перечисляет все правила, которым не соответствует пароль.
+type PolicyError struct {
+	Violations []Violation
+}
+
+func (e *PolicyError) Error() string {
+	rules := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		rules[i] = v.Rule
+	}
+	return "password violates policy: " + strings.Join(rules, ", ")
+}
+
+// Policy описывает требования к новым паролям. Существующие пароли
+// ей не проверяются, она применяется только при установке пароля.
+type Policy struct {
+	MinLength int
+	// MinClasses — сколько разных классов символов нужно из четырёх:
+	// строчные, заглавные, цифры и прочие символы.
+	MinClasses int
+	// Breached — словарь утёкших паролей, nil отключает проверку.
+	Breached *BreachedSet
+}
+
+func DefaultPolicy() Policy {
+	return Policy{MinLength: 10, MinClasses: 2}
+}
+
+// Check проверяет пароль. identifiers — имя пользователя, логин и т.п.,
+// которые не должны встречаться в пароле. Возвращает *PolicyError.
+func (p Policy) Check(password string, identifiers ...string) error {
+	var violations []Violation
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		violations = append(violations, Violation{RuleMinLength,
+			fmt.Sprintf("Пароль должен быть не короче %d символов", p.MinLength)})
+	}
+	if len(password) > maxPasswordSize {
+		violations = append(violations, Violation{RuleMaxLength,
+			fmt.Sprintf("Пароль должен быть не длиннее %d байт", maxPasswordSize)})
+	}
+	if strings.TrimSpace(password) == "" && password != "" {
+		violations = append(violations, Violation{RuleWhitespace, "Пароль не может состоять только из пробелов"})
+	}
+	if classes := characterClasses(password); classes < p.MinClasses {
+		violations = append(violations, Violation{RuleClasses,
+			fmt.Sprintf("Пароль должен содержать символы хотя бы %d видов из: строчные, заглавные, цифры, прочие", p.MinClasses)})
+	}
+
+	lower := strings.ToLower(password)
+	for _, id := range identifiers {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if utf8.RuneCountInString(id) >= minIdentifier && strings.Contains(lower, id) {
+			violations = append(violations, Violation{RuleIdentifier, "Пароль не должен содержать имя пользователя или логин"})
+			break
+		}
+	}
+
+	if p.Breached != nil && p.Breached.Contains(password) {
+		violations = append(violations, Violation{RuleBreached, "Пароль встречается в известных утечках, выберите другой"})
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	count := 0
+	for _, has := range []bool{lower, upper, digit, other} {
+		if has {
+			count++
+		}
+	}
+	return count
+}
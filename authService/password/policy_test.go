@@ -0,0 +1,82 @@
+package password
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func violatedRules(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("Check error = %T, want *PolicyError", err)
+	}
+	rules := make([]string, len(policyErr.Violations))
+	for i, v := range policyErr.Violations {
+		rules[i] = v.Rule
+	}
+	return rules
+}
+
+func TestPolicyCheck(t *testing.T) {
+	breached := newBreachedSet(1, falsePositiveRate)
+	breached.add(sha1Sum("Password123"))
+
+	policy := DefaultPolicy()
+	policy.Breached = breached
+
+	tests := []struct {
+		name        string
+		password    string
+		identifiers []string
+		rules       []string
+	}{
+		{"ok", "correct horse battery", nil, nil},
+		{"too short", "Ab1!", nil, []string{RuleMinLength}},
+		{"runes not bytes", "пароль-пароль", nil, nil},
+		{"one class", "abcdefghijkl", nil, []string{RuleClasses}},
+		{"too long", strings.Repeat("a1", 128), nil, []string{RuleMaxLength}},
+		{"whitespace", strings.Repeat(" ", 12), nil, []string{RuleWhitespace, RuleClasses}},
+		{"contains login", "xx-Alice-2024", []string{"alice"}, []string{RuleIdentifier}},
+		{"short identifier ignored", "xx-ab-2024-yy", []string{"ab"}, nil},
+		{"identifier reported once", "alice-bob-2024", []string{"alice", "bob"}, []string{RuleIdentifier}},
+		{"breached", "Password123", nil, []string{RuleBreached}},
+		{"everything", "al", []string{"al"}, []string{RuleMinLength, RuleClasses}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := violatedRules(t, policy.Check(tt.password, tt.identifiers...))
+			if !slices.Equal(rules, tt.rules) {
+				t.Errorf("Check(%q) rules = %v, want %v", tt.password, rules, tt.rules)
+			}
+		})
+	}
+}
+
+func TestPolicyWithoutBreachedSet(t *testing.T) {
+	if err := DefaultPolicy().Check("Password123"); err != nil {
+		t.Errorf("Check without corpus = %v, want nil", err)
+	}
+}
+
+func TestCharacterClasses(t *testing.T) {
+	tests := map[string]int{
+		"":         0,
+		"abc":      1,
+		"abcABC":   2,
+		"aB3":      3,
+		"aB3!":     4,
+		"ёЁ٣ ":     4,
+		"12345678": 1,
+	}
+	for pw, want := range tests {
+		if got := characterClasses(pw); got != want {
+			t.Errorf("characterClasses(%q) = %d, want %d", pw, got, want)
+		}
+	}
+}
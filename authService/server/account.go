@@ -0,0 +1,406 @@
+package server
+
+import (
+	"authService/db"
+	"authService/mail"
+	"authService/password"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// usernameChangeInterval ограничивает частоту смены имени, чтобы
+// нельзя было перебором занять много имён через историю.
+const usernameChangeInterval = 24 * time.Hour
+
+var errUsernameTaken = errors.New("username taken")
+
+type reauthRequest struct {
+	Password     string `json:"current_password" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// reauthenticate повторно проверяет пароль и, если включена 2FA, второй
+// фактор. Попытки идут в те же счётчики, что и у /auth/login и
+// /auth/login/2fa, и пишутся мимо транзакции, чтобы откат их не терял. При отказе ответ уже
+// отправлен.
+func reauthenticate(c *gin.Context, db *db.Database, tx pgx.Tx, hasher *password.Hasher, config Config, userID uuid.UUID, req reauthRequest) (string, bool) {
+	ctx := c.Request.Context()
+	limits := config.LoginLimits
+
+	var login, stored string
+	err := tx.QueryRow(ctx,
+		"SELECT login, password FROM auth WHERE user_id = $1 FOR UPDATE",
+		userID,
+	).Scan(&login, &stored)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return "", false
+	}
+
+	loginKey := loginThrottleKey(login)
+	if !acquireThrottled(c, db, limits, map[string]int{loginKey: limits.MaxFailuresPerLogin}) {
+		return "", false
+	}
+	if ok, _, _ := hasher.Verify(req.Password, stored); !ok {
+		audit(c, db, "auth.reauthenticate", userID.String(), auditFailure, gin.H{"reason": "bad_password", "path": c.FullPath()})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверный пароль"})
+		return "", false
+	}
+	if err := resetLoginFailures(ctx, db.Pool, loginKey); err != nil {
+		log.Printf("Failed to reset login failures for user %s: %v", userID, err)
+	}
+
+	enabled, err := twoFactorEnabled(ctx, tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return "", false
+	}
+	if enabled {
+		if req.Code == "" && req.RecoveryCode == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error":               "Требуется код двухфакторной аутентификации",
+				"two_factor_required": true,
+			})
+			return "", false
+		}
+		twoFactorKey := twoFactorThrottleKey(userID)
+		if !acquireThrottled(c, db, limits, map[string]int{twoFactorKey: limits.MaxFailuresPerLogin}) {
+			return "", false
+		}
+		ok, err := verifySecondFactor(ctx, tx, config.RecoveryCodeKey, userID, req.Code, req.RecoveryCode)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return "", false
+		}
+		if !ok {
+			audit(c, db, "auth.reauthenticate", userID.String(), auditFailure, gin.H{"reason": "bad_code", "path": c.FullPath()})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверный код"})
+			return "", false
+		}
+		if err := resetLoginFailures(ctx, db.Pool, twoFactorKey); err != nil {
+			log.Printf("Failed to reset 2FA failures for user %s: %v", userID, err)
+		}
+	}
+
+	return login, true
+}
+
+// revokeOtherSessions завершает все сессии пользователя, кроме текущей.
+func revokeOtherSessions(ctx context.Context, q querier, userID uuid.UUID, keep string) error {
+	_, err := q.Exec(ctx,
+		`UPDATE sessions
+		 SET revoked_at = CURRENT_TIMESTAMP
+		 WHERE user_id = $1 AND id::text <> $2 AND revoked_at IS NULL`,
+		userID, keep,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(ctx,
+		`UPDATE refresh_tokens
+		 SET revoked_at = CURRENT_TIMESTAMP
+		 WHERE user_id = $1 AND family_id::text <> $2 AND revoked_at IS NULL`,
+		userID, keep,
+	)
+	return err
+}
+
+// notifyAccountChange предупреждает владельца подтверждённого адреса
+// об изменении учётных данных.
+func notifyAccountChange(ctx context.Context, q querier, mailer mail.Mailer, userID uuid.UUID, subject, body string) {
+	var email *string
+	err := q.QueryRow(ctx,
+		"SELECT email FROM auth WHERE user_id = $1 AND email_verified_at IS NOT NULL",
+		userID,
+	).Scan(&email)
+	if err != nil || email == nil {
+		return
+	}
+	err = mailer.Send(ctx, mail.Message{
+		To:      *email,
+		Subject: subject,
+		Body:    body + "\n\nЕсли это были не вы, восстановите пароль и завершите все сессии.",
+	})
+	if err != nil {
+		log.Printf("Failed to send account change notice to user %s: %v", userID, err)
+	}
+}
+
+// checkUsernameAvailable проверяет, что имя не занято и не удерживается
+// после недавней смены другим пользователем. Сравнение без учёта регистра,
+// чтобы «Alice» нельзя было выдать за «alice».
+func checkUsernameAvailable(ctx context.Context, q querier, username string, userID uuid.UUID) error {
+	if _, err := q.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext(lower($1)))", username); err != nil {
+		return err
+	}
+
+	var taken bool
+	err := q.QueryRow(ctx,
+		`SELECT EXISTS(SELECT 1 FROM users WHERE lower(username) = lower($1) AND id <> $2)
+		     OR EXISTS(SELECT 1 FROM username_history
+		               WHERE lower(username) = lower($1)
+		                 AND user_id IS DISTINCT FROM $2
+		                 AND reserved_until > CURRENT_TIMESTAMP)`,
+		username, userID,
+	).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errUsernameTaken
+	}
+	return nil
+}
+
+// reserveUsername удерживает освободившееся имя за прежним владельцем.
+func reserveUsername(ctx context.Context, q querier, userID uuid.UUID, username string, hold time.Duration) error {
+	_, err := q.Exec(ctx,
+		`INSERT INTO username_history (user_id, username, reserved_until)
+		 VALUES ($1, $2, $3)`,
+		userID, username, time.Now().Add(hold),
+	)
+	return err
+}
+
+// checkPassword проверяет пароль по политике и при нарушении сам отвечает
+// клиенту списком всех невыполненных правил.
+func checkPassword(c *gin.Context, policy password.Policy, pw string, identifiers ...string) bool {
+	err := policy.Check(pw, identifiers...)
+	var policyErr *password.PolicyError
+	if errors.As(err, &policyErr) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "Пароль не соответствует требованиям",
+			"violations": policyErr.Violations,
+		})
+		return false
+	}
+	return true
+}
+
+func ChangePassword(db *db.Database, hasher *password.Hasher, mailer mail.Mailer, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			reauthRequest
+			NewPassword string `json:"new_password" binding:"required,max=255"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userID, err := uuid.Parse(c.GetString("user_id"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		login, ok := reauthenticate(c, db, tx, hasher, config, userID, req.reauthRequest)
+		if !ok {
+			return
+		}
+		if !checkPassword(c, config.PasswordPolicy, req.NewPassword, login, c.GetString("username")) {
+			return
+		}
+
+		hash, err := hasher.Hash(req.NewPassword)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Не удалось обработать пароль"})
+			return
+		}
+
+		if _, err := tx.Exec(ctx, "UPDATE auth SET password = $1 WHERE user_id = $2", hash, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при сохранении пароля"})
+			return
+		}
+
+		claims := c.MustGet("claims").(*Claims)
+		if err := revokeOtherSessions(ctx, tx, userID, claims.SessionID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при завершении сессий"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		audit(c, db, "password.change", userID.String(), auditSuccess, nil)
+		notifyAccountChange(ctx, db.Pool, mailer, userID, "Пароль изменён",
+			"Пароль вашей учётной записи был изменён, остальные сессии завершены.")
+		c.JSON(http.StatusOK, gin.H{"message": "Пароль изменён, остальные сессии завершены"})
+	}
+}
+
+func ChangeLogin(db *db.Database, hasher *password.Hasher, mailer mail.Mailer, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			reauthRequest
+			Login string `json:"login" binding:"required,max=255"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userID, err := uuid.Parse(c.GetString("user_id"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		newLogin := strings.TrimSpace(req.Login)
+		if newLogin == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Логин не может быть пустым"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		oldLogin, ok := reauthenticate(c, db, tx, hasher, config, userID, req.reauthRequest)
+		if !ok {
+			return
+		}
+		if oldLogin == newLogin {
+			c.JSON(http.StatusOK, gin.H{"message": "Логин не изменился", "login": newLogin})
+			return
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE auth SET login = $1 WHERE user_id = $2", newLogin, userID)
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Логин уже занят"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при сохранении логина"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		audit(c, db, "login.change", userID.String(), auditSuccess, nil)
+		notifyAccountChange(ctx, db.Pool, mailer, userID, "Логин изменён",
+			"Логин для входа в вашу учётную запись был изменён.")
+		c.JSON(http.StatusOK, gin.H{"message": "Логин изменён", "login": newLogin})
+	}
+}
+
+func ChangeUsername(db *db.Database, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Username string `json:"username" binding:"required,max=50"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userID, err := uuid.Parse(c.GetString("user_id"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		username := strings.TrimSpace(req.Username)
+		if username == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Имя пользователя не может быть пустым"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var current string
+		var lastChange *time.Time
+		err = tx.QueryRow(ctx,
+			`SELECT u.username,
+			        (SELECT max(changed_at) FROM username_history WHERE user_id = u.id)
+			 FROM users u
+			 WHERE u.id = $1
+			 FOR UPDATE`,
+			userID,
+		).Scan(&current, &lastChange)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if current == username {
+			c.JSON(http.StatusOK, gin.H{"message": "Имя не изменилось", "username": username})
+			return
+		}
+		if lastChange != nil && time.Since(*lastChange) < usernameChangeInterval {
+			c.Header("Retry-After", strconv.Itoa(int((usernameChangeInterval-time.Since(*lastChange)).Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Имя можно менять не чаще раза в сутки"})
+			return
+		}
+
+		if err := checkUsernameAvailable(ctx, tx, username, userID); err != nil {
+			if errors.Is(err, errUsernameTaken) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Имя пользователя занято"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE users SET username = $1 WHERE id = $2", username, userID)
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Имя пользователя занято"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при сохранении имени"})
+			return
+		}
+		if err := reserveUsername(ctx, tx, userID, current, config.UsernameHold); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при сохранении истории имён"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		audit(c, db, "username.change", userID.String(), auditSuccess, nil)
+		// Имя в access-токене обновится при следующем refresh.
+		c.JSON(http.StatusOK, gin.H{
+			"message":           "Имя пользователя изменено",
+			"username":          username,
+			"previous_username": current,
+		})
+	}
+}
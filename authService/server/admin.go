@@ -0,0 +1,359 @@
+package server
+
+import (
+	"authService/db"
+	"authService/outbox"
+	"authService/password"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Операции из этого файла нужны и обработчикам, и командам администратора
+// в main.go, поэтому они не зависят от gin.
+
+var (
+	errLoginTaken = errors.New("login already taken")
+	errEmailTaken = errors.New("email already in use")
+
+	ErrUserNotFound  = errors.New("user not found")
+	ErrAmbiguousUser = errors.New("ambiguous user")
+	ErrRoleNotFound  = errors.New("role not found")
+	ErrGroupNotFound = errors.New("group not found")
+)
+
+// checkRegistration проверяет, что логин ещё никем не занят, а адрес никем
+// не подтверждён.
+func checkRegistration(ctx context.Context, q querier, login string, email *string) error {
+	var loginTaken, emailTaken bool
+	err := q.QueryRow(ctx,
+		`SELECT EXISTS(SELECT 1 FROM auth WHERE login = $1),
+		        $2::text IS NOT NULL AND EXISTS(
+		            SELECT 1 FROM auth WHERE lower(email) = $2 AND email_verified_at IS NOT NULL)`,
+		login, email,
+	).Scan(&loginTaken, &emailTaken)
+	switch {
+	case err != nil:
+		return err
+	case loginTaken:
+		return errLoginTaken
+	case emailTaken:
+		return errEmailTaken
+	}
+	return nil
+}
+
+// createUser заводит пользователя со всем, что ему положено при регистрации:
+// профилем, общей группой, ролью user и событием user.registered.
+func createUser(ctx context.Context, tx pgx.Tx, userID uuid.UUID, username, login, hash string, email *string) error {
+	if err := checkUsernameAvailable(ctx, tx, username, userID); err != nil {
+		return err
+	}
+
+	steps := []struct {
+		sql  string
+		args []any
+	}{
+		{"INSERT INTO users (id, username) VALUES ($1, $2)", []any{userID, username}},
+		{"INSERT INTO auth (user_id, login, password, email) VALUES ($1, $2, $3, $4)", []any{userID, login, hash, email}},
+		{"INSERT INTO user_group (user_id, group_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", []any{userID, openGroupID}},
+		{"INSERT INTO profiles (user_id) VALUES ($1) ON CONFLICT DO NOTHING", []any{userID}},
+		{"INSERT INTO user_roles (user_id, role) VALUES ($1, $2) ON CONFLICT DO NOTHING", []any{userID, RoleUser}},
+	}
+	for _, step := range steps {
+		if _, err := tx.Exec(ctx, step.sql, step.args...); err != nil {
+			return takenError(err)
+		}
+	}
+
+	return outbox.Enqueue(ctx, tx, outbox.TypeUserRegistered,
+		outbox.UserRegistered{UserID: userID, Username: username})
+}
+
+// takenError переводит нарушение уникальности в ошибку о занятом поле
+// по имени ограничения. Прочие нарушения возвращаются как есть.
+func takenError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+		return err
+	}
+	switch pgErr.ConstraintName {
+	case "auth_login_key":
+		return errLoginTaken
+	case "idx_auth_email":
+		return errEmailTaken
+	case "users_username_key":
+		return errUsernameTaken
+	}
+	return err
+}
+
+// resolveUser принимает id, логин или имя пользователя. Если логин одного
+// пользователя совпадает с именем другого, угадывать нельзя: возвращается
+// ErrAmbiguousUser, и нужно указать id.
+func resolveUser(ctx context.Context, q querier, ident string) (uuid.UUID, error) {
+	rows, err := q.Query(ctx,
+		`SELECT DISTINCT u.id, u.id::text = $1 FROM users u
+		 LEFT JOIN auth a ON a.user_id = u.id
+		 WHERE u.id::text = $1 OR a.login = $1 OR lower(u.username) = lower($1)`,
+		ident,
+	)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer rows.Close()
+
+	var matches []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		var byID bool
+		if err := rows.Scan(&id, &byID); err != nil {
+			return uuid.Nil, err
+		}
+		if byID {
+			return id, nil
+		}
+		matches = append(matches, id)
+	}
+	if err := rows.Err(); err != nil {
+		return uuid.Nil, err
+	}
+	switch len(matches) {
+	case 0:
+		return uuid.Nil, fmt.Errorf("%w: %s", ErrUserNotFound, ident)
+	case 1:
+		return matches[0], nil
+	}
+	return uuid.Nil, fmt.Errorf("%w: %s matches %d users by login and username, use the user id", ErrAmbiguousUser, ident, len(matches))
+}
+
+// auditCLI пишет в журнал действие, выполненное из командной строки.
+// Актора нет, поэтому в metadata попадает пользователь ОС.
+func auditCLI(ctx context.Context, db *db.Database, action, target string, metadata map[string]any) {
+	if metadata == nil {
+		metadata = map[string]any{}
+	}
+	metadata["via"] = "cli"
+	if u, err := user.Current(); err == nil {
+		metadata["os_user"] = u.Username
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		data = []byte("{}")
+	}
+	_, err = db.Pool.Exec(ctx,
+		`INSERT INTO audit_events (action, target, user_agent, result, metadata)
+		 VALUES ($1, $2, 'authService-cli', $3, $4)`,
+		action, target, auditSuccess, data,
+	)
+	if err != nil {
+		log.Printf("Failed to write audit event %s: %v", action, err)
+	}
+}
+
+type NewUser struct {
+	Username string
+	Login    string
+	Password string
+	Email    string
+}
+
+// CreateUser регистрирует пользователя так же, как /auth/register,
+// но без письма с подтверждением адреса.
+func CreateUser(ctx context.Context, db *db.Database, hasher *password.Hasher, policy password.Policy, u NewUser) (uuid.UUID, error) {
+	if err := policy.Check(u.Password, u.Username, u.Login, u.Email); err != nil {
+		return uuid.Nil, err
+	}
+	var email *string
+	if u.Email != "" {
+		lower := strings.ToLower(u.Email)
+		email = &lower
+	}
+	if err := checkRegistration(ctx, db.Pool, u.Login, email); err != nil {
+		return uuid.Nil, err
+	}
+
+	hash, err := hasher.Hash(u.Password)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	userID := uuid.New()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := createUser(ctx, tx, userID, u.Username, u.Login, hash, email); err != nil {
+		return uuid.Nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return uuid.Nil, err
+	}
+
+	auditCLI(ctx, db, "user.register", userID.String(), nil)
+	return userID, nil
+}
+
+// ResetUserPassword задаёт новый пароль и завершает все сессии пользователя.
+func ResetUserPassword(ctx context.Context, db *db.Database, hasher *password.Hasher, policy password.Policy, ident, newPassword string) (int64, error) {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	userID, err := resolveUser(ctx, tx, ident)
+	if err != nil {
+		return 0, err
+	}
+	var login, username string
+	err = tx.QueryRow(ctx,
+		"SELECT a.login, u.username FROM auth a JOIN users u ON u.id = a.user_id WHERE a.user_id = $1 FOR UPDATE OF a",
+		userID,
+	).Scan(&login, &username)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, fmt.Errorf("user %s has no password login", ident)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := policy.Check(newPassword, login, username); err != nil {
+		return 0, err
+	}
+
+	hash, err := hasher.Hash(newPassword)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx,
+		"UPDATE auth SET password = $1, tokens_valid_after = $3 WHERE user_id = $2",
+		hash, userID, time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	revoked, err := revokeUserSessions(ctx, tx, userID.String())
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	auditCLI(ctx, db, "password.reset", userID.String(), map[string]any{"sessions_revoked": revoked})
+	return revoked, nil
+}
+
+// SetUserRole выдаёт или снимает роль. Последнего администратора
+// разжаловать нельзя, как и через API.
+func SetUserRole(ctx context.Context, db *db.Database, ident, role string, grant bool) error {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	userID, err := resolveUser(ctx, tx, ident)
+	if err != nil {
+		return err
+	}
+
+	action := "role.assign"
+	if grant {
+		var exists bool
+		if err := tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM roles WHERE name = $1)", role).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: %s", ErrRoleNotFound, role)
+		}
+		_, err = tx.Exec(ctx,
+			"INSERT INTO user_roles (user_id, role) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			userID, role,
+		)
+	} else {
+		action = "role.revoke"
+		if role == RoleAdmin {
+			if err := ensureNotLastAdmin(ctx, tx, userID); err != nil {
+				if errors.Is(err, errLastAdmin) {
+					return fmt.Errorf("refusing to revoke the last admin")
+				}
+				return err
+			}
+		}
+		_, err = tx.Exec(ctx, "DELETE FROM user_roles WHERE user_id = $1 AND role = $2", userID, role)
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	auditCLI(ctx, db, action, userID.String(), map[string]any{"role": role})
+	return nil
+}
+
+// AddGroupMember добавляет пользователя в группу. false — он уже в ней.
+func AddGroupMember(ctx context.Context, db *db.Database, groupID uuid.UUID, ident string) (bool, error) {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	userID, err := resolveUser(ctx, tx, ident)
+	if err != nil {
+		return false, err
+	}
+	var exists bool
+	if err := tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM groups WHERE id = $1)", groupID).Scan(&exists); err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, fmt.Errorf("%w: %s", ErrGroupNotFound, groupID)
+	}
+
+	added, err := changeMembers(ctx, tx,
+		`INSERT INTO user_group (user_id, group_id)
+		 SELECT u.id, $1 FROM users u WHERE u.id = ANY($2::uuid[])
+		 ON CONFLICT DO NOTHING
+		 RETURNING user_id`,
+		groupID, []uuid.UUID{userID}, outbox.TypeGroupMembersAdded,
+	)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+
+	if added > 0 {
+		auditCLI(ctx, db, "group.members_add", groupID.String(), map[string]any{"user_ids": []uuid.UUID{userID}})
+	}
+	return added > 0, nil
+}
+
+// InspectToken разбирает access-токен и сообщает, отозван ли он.
+func InspectToken(ctx context.Context, db *db.Database, tokens *TokenIssuer, raw string) (*Claims, bool, error) {
+	claims, err := tokens.Parse(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	revoked, err := tokenRevoked(ctx, db.Pool, claims)
+	if err != nil {
+		return nil, false, err
+	}
+	return claims, revoked, nil
+}
@@ -1,33 +1,119 @@
 package server
 
 import (
+	"crypto/subtle"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"authService/db"
+	"authService/mail"
+	"authService/password"
 
 	"github.com/gin-gonic/gin"
 )
 
+type Config struct {
+	// TOTPIssuer отображается в приложении-аутентификаторе.
+	TOTPIssuer string
+	// AppURL — адрес клиента, на который ведут ссылки из писем.
+	AppURL         string
+	VerifyTokenTTL time.Duration
+	ResetTokenTTL  time.Duration
+	LoginLimits    LoginLimits
+	// UsernameHold — сколько прежнее имя пользователя недоступно другим.
+	UsernameHold time.Duration
+	// ServiceTokens — имя сервиса и его токен для внутренних эндпоинтов.
+	ServiceTokens map[string]string
+	// PasswordPolicy проверяет пароли при регистрации, смене и сбросе.
+	PasswordPolicy password.Policy
+	// RecoveryCodeKey — ключ HMAC для кодов восстановления 2FA.
+	RecoveryCodeKey []byte
+}
+
 type Server struct {
-	db        *db.Database
-	router    *gin.Engine
-	jwtSecret string
+	db     *db.Database
+	router *gin.Engine
+	tokens *TokenIssuer
+	hasher *password.Hasher
+	mailer mail.Mailer
+	config Config
 }
 
-func New(database *db.Database, jwtSecret string) *Server {
+func New(database *db.Database, tokens *TokenIssuer, hasher *password.Hasher, mailer mail.Mailer, config Config) *Server {
 	router := gin.Default()
 
 	s := &Server{
-		db:        database,
-		router:    router,
-		jwtSecret: jwtSecret,
+		db:     database,
+		router: router,
+		tokens: tokens,
+		hasher: hasher,
+		mailer: mailer,
+		config: config,
 	}
 
 	s.setupRoutes()
 	return s
 }
 
+func AuthMiddleware(db *db.Database, tokens *TokenIssuer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is required"})
+			return
+		}
+
+		parts := strings.Split(authHeader, " ")
+		claims, err := tokens.Parse(parts[len(parts)-1])
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		revoked, err := tokenRevoked(c.Request.Context(), db.Pool, claims)
+		if err != nil {
+			log.Printf("Failed to check token revocation: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token revoked"})
+			return
+		}
+
+		if claims.SessionID != "" {
+			if err := touchSession(c.Request.Context(), db.Pool, claims.SessionID); err != nil {
+				log.Printf("Failed to update session %s: %v", claims.SessionID, err)
+			}
+		}
+
+		c.Set("user_id", claims.UserID)
+		c.Set("username", claims.Username)
+		c.Set("groups", claims.Groups)
+		c.Set("roles", claims.Roles)
+		c.Set("claims", claims)
+
+		c.Next()
+	}
+}
+
+// ServiceAuth пускает только сервисы, предъявившие токен из Config.ServiceTokens.
+func ServiceAuth(tokens map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		for name, expected := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+				c.Set("service", name)
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid service token"})
+	}
+}
+
 func (s *Server) setupRoutes() {
 	s.router.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
@@ -37,14 +123,73 @@ func (s *Server) setupRoutes() {
 		})
 	})
 
+	s.router.GET("/.well-known/jwks.json", JWKS(s.tokens))
+
 	auth := s.router.Group("/auth")
 	{
-		auth.POST("/register", Register(s.db))
-		auth.POST("/login", Login(s.db, s.jwtSecret))
+		auth.POST("/register", Register(s.db, s.hasher, s.mailer, s.config))
+		auth.POST("/login", Login(s.db, s.tokens, s.hasher, s.config.LoginLimits))
+		auth.POST("/login/2fa", Login2FA(s.db, s.tokens, s.config))
+		auth.POST("/refresh", Refresh(s.db, s.tokens))
+		auth.POST("/verify", VerifyEmail(s.db))
+		auth.POST("/password/forgot", ForgotPassword(s.db, s.mailer, s.config))
+		auth.POST("/password/reset", ResetPassword(s.db, s.hasher, s.config))
 		auth.GET("user/:id", GetUser(s.db))
-		auth.DELETE("user/:id", DeleteUser(s.db))
 	}
 
+	internal := s.router.Group("/auth")
+	internal.Use(ServiceAuth(s.config.ServiceTokens))
+	{
+		internal.POST("/introspect", Introspect(s.db, s.tokens))
+		internal.POST("/users/batch", BatchUsers(s.db))
+		internal.POST("/api-keys/verify", VerifyAPIKey(s.db))
+	}
+
+	authed := s.router.Group("/auth")
+	authed.Use(AuthMiddleware(s.db, s.tokens))
+	{
+		authed.POST("/logout", Logout(s.db))
+		authed.POST("/logout-all", LogoutAll(s.db))
+		authed.GET("/sessions", ListSessions(s.db))
+		authed.DELETE("/sessions/:id", RevokeSession(s.db))
+		authed.POST("/2fa/enroll", Enroll2FA(s.db, s.config.TOTPIssuer))
+		authed.POST("/2fa/verify", Verify2FA(s.db, s.config))
+		authed.POST("/2fa/disable", Disable2FA(s.db, s.hasher, s.config))
+		authed.PUT("/email", SetEmail(s.db, s.mailer, s.config))
+		authed.PUT("/password", ChangePassword(s.db, s.hasher, s.mailer, s.config))
+		authed.PUT("/login", ChangeLogin(s.db, s.hasher, s.mailer, s.config))
+		authed.PUT("/username", ChangeUsername(s.db, s.config))
+		authed.GET("/groups", ListGroups(s.db))
+		authed.GET("/groups/:id/members", GetGroupMembers(s.db))
+		authed.GET("/user/:id/groups", GetUserGroups(s.db))
+
+		authed.GET("/user/me", GetMe(s.db))
+		authed.PATCH("/user/me", UpdateMe(s.db))
+		authed.DELETE("user/:id", DeleteUser(s.db, s.config))
+		authed.GET("/users", RequirePermission(PermUsersList), ListUsers(s.db))
+		authed.GET("/users/directory", SearchDirectory(s.db))
+
+		authed.POST("/groups", RequirePermission(PermGroupsManage), CreateGroup(s.db))
+		authed.PATCH("/groups/:id", RequirePermission(PermGroupsManage), RenameGroup(s.db))
+		authed.DELETE("/groups/:id", RequirePermission(PermGroupsManage), DeleteGroup(s.db))
+		authed.POST("/groups/:id/members", RequirePermission(PermGroupsManage), AddGroupMembers(s.db))
+		authed.DELETE("/groups/:id/members", RequirePermission(PermGroupsManage), RemoveGroupMembers(s.db))
+
+		authed.GET("/roles", RequirePermission(PermRolesManage), ListRoles(s.db))
+		authed.GET("/user/:id/roles", RequirePermission(PermRolesManage), GetUserRoles(s.db))
+		authed.POST("/user/:id/roles", RequirePermission(PermRolesManage), AssignRole(s.db))
+		authed.DELETE("/user/:id/roles/:role", RequirePermission(PermRolesManage), RevokeRole(s.db))
+
+		authed.POST("/admin/unlock", RequirePermission(PermAccountsUnlock), UnlockAccount(s.db))
+		authed.GET("/admin/audit", RequirePermission(PermAuditRead), ListAuditEvents(s.db))
+		authed.GET("/admin/audit/export", RequirePermission(PermAuditRead), ExportAuditEvents(s.db))
+
+		authed.GET("/service-accounts", RequirePermission(PermServiceAccountsManage), ListServiceAccounts(s.db))
+		authed.POST("/service-accounts", RequirePermission(PermServiceAccountsManage), CreateServiceAccount(s.db, s.config))
+		authed.GET("/service-accounts/:id/keys", RequirePermission(PermServiceAccountsManage), ListAPIKeys(s.db))
+		authed.POST("/service-accounts/:id/keys", RequirePermission(PermServiceAccountsManage), CreateAPIKey(s.db))
+		authed.DELETE("/service-accounts/:id/keys/:keyId", RequirePermission(PermServiceAccountsManage), RevokeAPIKey(s.db))
+	}
 }
 
 func (s *Server) Start(addr string) error {
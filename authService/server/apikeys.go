@@ -0,0 +1,433 @@
+package server
+
+import (
+	"authService/db"
+	"authService/outbox"
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// apiKeyPrefix отличает ключ от JWT и облегчает поиск утёкших ключей.
+	apiKeyPrefix    = "4at_"
+	maxKeysPerOwner = 20
+)
+
+// Области действия API-ключей. Ключ даёт только перечисленные в нём.
+const (
+	ScopeChatRead  = "chat:read"
+	ScopeChatWrite = "chat:write"
+)
+
+var apiKeyScopes = []string{ScopeChatRead, ScopeChatWrite}
+
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// newAPIKey возвращает ключ вида 4at_<prefix>_<secret>. Хранится только
+// хеш, prefix остаётся открытым, чтобы ключ можно было узнать в списке.
+func newAPIKey() (raw, prefix string, err error) {
+	prefix, err = randomToken(6)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	// В base64url встречается «_», а он разделяет части ключа.
+	prefix = strings.NewReplacer("_", "a", "-", "b").Replace(prefix)
+	return apiKeyPrefix + prefix + "_" + secret, prefix, nil
+}
+
+// serviceAccount проверяет, что :id — сервисный аккаунт.
+func serviceAccount(c *gin.Context, q querier) (uuid.UUID, bool) {
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор пользователя"})
+		return uuid.Nil, false
+	}
+	var isService bool
+	err = q.QueryRow(c.Request.Context(), "SELECT is_service FROM users WHERE id = $1", userID).Scan(&isService)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !isService) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Сервисный аккаунт не найден"})
+		return uuid.Nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// CreateServiceAccount заводит пользователя без логина и пароля, который
+// входит только по API-ключам.
+func CreateServiceAccount(db *db.Database, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Username    string `json:"username" binding:"required,max=50"`
+			DisplayName string `json:"display_name" binding:"max=100"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userID := uuid.New()
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		if err := checkUsernameAvailable(ctx, tx, req.Username, userID); err != nil {
+			if errors.Is(err, errUsernameTaken) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Имя пользователя занято"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		var displayName *string
+		if name := strings.TrimSpace(req.DisplayName); name != "" {
+			displayName = &name
+		}
+		steps := []struct {
+			sql  string
+			args []any
+		}{
+			{"INSERT INTO users (id, username, is_service) VALUES ($1, $2, TRUE)", []any{userID, req.Username}},
+			{"INSERT INTO profiles (user_id, display_name) VALUES ($1, $2)", []any{userID, displayName}},
+			{"INSERT INTO user_group (user_id, group_id) VALUES ($1, $2)", []any{userID, openGroupID}},
+			{"INSERT INTO user_roles (user_id, role, granted_by) VALUES ($1, $2, $3)", []any{userID, RoleUser, c.GetString("user_id")}},
+		}
+		for _, step := range steps {
+			if _, err := tx.Exec(ctx, step.sql, step.args...); err != nil {
+				if isUniqueViolation(err) {
+					c.JSON(http.StatusConflict, gin.H{"error": "Имя пользователя занято"})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании сервисного аккаунта"})
+				return
+			}
+		}
+
+		err = outbox.Enqueue(ctx, tx, outbox.TypeUserRegistered,
+			outbox.UserRegistered{UserID: userID, Username: req.Username})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при записи события"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		audit(c, db, "service_account.create", userID.String(), auditSuccess, nil)
+		c.JSON(http.StatusCreated, gin.H{
+			"user_id":    userID.String(),
+			"username":   req.Username,
+			"is_service": true,
+		})
+	}
+}
+
+func ListServiceAccounts(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, offset, ok := pagination(c)
+		if !ok {
+			return
+		}
+
+		rows, err := db.Pool.Query(c.Request.Context(),
+			`SELECT u.id, u.username, u.created_at, p.display_name,
+			        (SELECT count(*) FROM api_keys k
+			         WHERE k.user_id = u.id AND k.revoked_at IS NULL
+			           AND (k.expires_at IS NULL OR k.expires_at > CURRENT_TIMESTAMP))
+			 FROM users u
+			 LEFT JOIN profiles p ON p.user_id = u.id
+			 WHERE u.is_service
+			 ORDER BY u.created_at, u.id
+			 LIMIT $1 OFFSET $2`,
+			limit, offset,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		defer rows.Close()
+
+		accounts := make([]gin.H, 0)
+		for rows.Next() {
+			var id uuid.UUID
+			var username string
+			var createdAt time.Time
+			var displayName *string
+			var activeKeys int
+			if err := rows.Scan(&id, &username, &createdAt, &displayName, &activeKeys); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении аккаунтов"})
+				return
+			}
+			accounts = append(accounts, gin.H{
+				"id":           id.String(),
+				"username":     username,
+				"display_name": displayName,
+				"created_at":   createdAt.Format(time.RFC3339),
+				"active_keys":  activeKeys,
+			})
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении аккаунтов"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"service_accounts": accounts, "limit": limit, "offset": offset})
+	}
+}
+
+func CreateAPIKey(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Name      string     `json:"name" binding:"required,max=100"`
+			Scopes    []string   `json:"scopes" binding:"required,min=1"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		for _, scope := range req.Scopes {
+			if !slices.Contains(apiKeyScopes, scope) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Неизвестная область действия: " + scope, "scopes": apiKeyScopes})
+				return
+			}
+		}
+		slices.Sort(req.Scopes)
+		req.Scopes = slices.Compact(req.Scopes)
+		if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Срок действия уже истёк"})
+			return
+		}
+
+		userID, ok := serviceAccount(c, db.Pool)
+		if !ok {
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		// Строка владельца сериализует выпуск ключей, иначе параллельные
+		// запросы проходят проверку лимита вместе.
+		if _, err := tx.Exec(ctx, "SELECT 1 FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		var active int
+		err = tx.QueryRow(ctx,
+			"SELECT count(*) FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL",
+			userID,
+		).Scan(&active)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if active >= maxKeysPerOwner {
+			c.JSON(http.StatusConflict, gin.H{"error": "Слишком много активных ключей, отзовите ненужные"})
+			return
+		}
+
+		raw, prefix, err := newAPIKey()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании ключа"})
+			return
+		}
+
+		key := APIKey{Name: req.Name, Prefix: prefix, Scopes: req.Scopes, ExpiresAt: req.ExpiresAt}
+		err = tx.QueryRow(ctx,
+			`INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at, created_by)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7)
+			 RETURNING id, created_at`,
+			userID, req.Name, prefix, hashToken(raw), req.Scopes, req.ExpiresAt, c.GetString("user_id"),
+		).Scan(&key.ID, &key.CreatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании ключа"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		audit(c, db, "api_key.create", userID.String(), auditSuccess,
+			gin.H{"key_id": key.ID, "prefix": prefix, "scopes": req.Scopes})
+		// Сам ключ показывается один раз, восстановить его потом нельзя.
+		c.JSON(http.StatusCreated, gin.H{"key": raw, "api_key": key})
+	}
+}
+
+func ListAPIKeys(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := serviceAccount(c, db.Pool)
+		if !ok {
+			return
+		}
+
+		rows, err := db.Pool.Query(c.Request.Context(),
+			`SELECT id, name, prefix, scopes, created_at, expires_at, last_used_at, revoked_at
+			 FROM api_keys
+			 WHERE user_id = $1
+			 ORDER BY created_at DESC`,
+			userID,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		defer rows.Close()
+
+		keys := make([]APIKey, 0)
+		for rows.Next() {
+			var k APIKey
+			if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.Scopes, &k.CreatedAt, &k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении ключей"})
+				return
+			}
+			keys = append(keys, k)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении ключей"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+	}
+}
+
+func RevokeAPIKey(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := serviceAccount(c, db.Pool)
+		if !ok {
+			return
+		}
+		keyID, err := uuid.Parse(c.Param("keyId"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор ключа"})
+			return
+		}
+
+		cmdTag, err := db.Pool.Exec(c.Request.Context(),
+			`UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP
+			 WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`,
+			keyID, userID,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if cmdTag.RowsAffected() == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Ключ не найден или уже отозван"})
+			return
+		}
+
+		audit(c, db, "api_key.revoke", userID.String(), auditSuccess, gin.H{"key_id": keyID})
+		c.JSON(http.StatusOK, gin.H{"message": "Ключ отозван", "key_id": keyID.String()})
+	}
+}
+
+// lookupAPIKey находит действующий ключ и отмечает его использование
+// не чаще раза в минуту.
+func lookupAPIKey(ctx context.Context, q querier, raw, ip string) (uuid.UUID, string, []string, error) {
+	var keyID, userID uuid.UUID
+	var username string
+	var scopes []string
+	err := q.QueryRow(ctx,
+		`SELECT k.id, k.user_id, u.username, k.scopes
+		 FROM api_keys k
+		 JOIN users u ON u.id = k.user_id
+		 WHERE k.key_hash = $1 AND k.revoked_at IS NULL
+		   AND (k.expires_at IS NULL OR k.expires_at > CURRENT_TIMESTAMP)`,
+		hashToken(raw),
+	).Scan(&keyID, &userID, &username, &scopes)
+	if err != nil {
+		return uuid.Nil, "", nil, err
+	}
+
+	_, err = q.Exec(ctx,
+		`UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP, last_used_ip = $2
+		 WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute')`,
+		keyID, ip,
+	)
+	return userID, username, scopes, err
+}
+
+// VerifyAPIKey — внутренний эндпоинт, через который другие сервисы
+// проверяют API-ключи клиентов.
+func VerifyAPIKey(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Key string `json:"key" binding:"required"`
+			// IP — адрес клиента, который пришёл к вызывающему сервису.
+			IP string `json:"ip"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !strings.HasPrefix(req.Key, apiKeyPrefix) {
+			c.JSON(http.StatusOK, gin.H{"active": false})
+			return
+		}
+
+		ctx := c.Request.Context()
+		userID, username, scopes, err := lookupAPIKey(ctx, db.Pool, req.Key, req.IP)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusOK, gin.H{"active": false})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		groups, err := userGroups(ctx, db.Pool, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении групп"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"active":   true,
+			"user_id":  userID.String(),
+			"username": username,
+			"groups":   groups,
+			"scopes":   scopes,
+		})
+	}
+}
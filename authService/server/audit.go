@@ -0,0 +1,227 @@
+package server
+
+import (
+	"authService/db"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+	auditDenied  = "denied"
+)
+
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	ActorID    *uuid.UUID      `json:"actor_id"`
+	Action     string          `json:"action"`
+	Target     *string         `json:"target"`
+	IP         *string         `json:"ip"`
+	UserAgent  *string         `json:"user_agent"`
+	Result     string          `json:"result"`
+	Metadata   json.RawMessage `json:"metadata"`
+}
+
+// audit пишет событие от имени текущего пользователя запроса.
+func audit(c *gin.Context, db *db.Database, action, target, result string, metadata gin.H) {
+	auditAs(c, db, c.GetString("user_id"), action, target, result, metadata)
+}
+
+// auditAs пишет событие мимо транзакции обработчика: неудачные попытки
+// тоже должны остаться в журнале, даже если транзакция откатилась.
+// Ошибка записи только логируется и не ломает сам запрос.
+//
+// Журнал нельзя править, поэтому пользователи в нём называются только по
+// id: логин, почта или имя остались бы в нём и после удаления аккаунта.
+func auditAs(c *gin.Context, db *db.Database, actorID, action, target, result string, metadata gin.H) {
+	var actor *uuid.UUID
+	if id, err := uuid.Parse(actorID); err == nil {
+		actor = &id
+	}
+	var targetValue *string
+	if target != "" {
+		targetValue = &target
+	}
+	if metadata == nil {
+		metadata = gin.H{}
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		log.Printf("Failed to encode audit metadata for %s: %v", action, err)
+		data = []byte("{}")
+	}
+
+	_, err = db.Pool.Exec(c.Request.Context(),
+		`INSERT INTO audit_events (actor_id, action, target, ip, user_agent, result, metadata)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		actor, action, targetValue, c.ClientIP(), c.Request.UserAgent(), result, data,
+	)
+	if err != nil {
+		log.Printf("Failed to write audit event %s (%s): %v", action, result, err)
+	}
+}
+
+// auditFilter собирает WHERE по параметрам запроса: actor, action
+// (точное значение или префикс с «*» на конце), target, result, ip,
+// from и to в RFC 3339.
+func auditFilter(c *gin.Context) (string, []any, error) {
+	var conditions []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if v := c.Query("actor"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return "", nil, fmt.Errorf("некорректный actor")
+		}
+		conditions = append(conditions, "actor_id = "+arg(id))
+	}
+	if v := c.Query("action"); v != "" {
+		if prefix, ok := strings.CutSuffix(v, "*"); ok {
+			conditions = append(conditions, "action LIKE "+arg(strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix)+"%"))
+		} else {
+			conditions = append(conditions, "action = "+arg(v))
+		}
+	}
+	if v := c.Query("target"); v != "" {
+		conditions = append(conditions, "target = "+arg(v))
+	}
+	if v := c.Query("result"); v != "" {
+		conditions = append(conditions, "result = "+arg(v))
+	}
+	if v := c.Query("ip"); v != "" {
+		conditions = append(conditions, "ip = "+arg(v))
+	}
+	for _, bound := range []struct{ param, op string }{{"from", ">="}, {"to", "<"}} {
+		v := c.Query(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", nil, fmt.Errorf("некорректный %s, нужен RFC 3339", bound.param)
+		}
+		conditions = append(conditions, "occurred_at "+bound.op+" "+arg(t))
+	}
+	if v := c.Query("before"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("некорректный before")
+		}
+		conditions = append(conditions, "id < "+arg(id))
+	}
+
+	if len(conditions) == 0 {
+		return "", args, nil
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+const auditColumns = "id, occurred_at, actor_id, action, target, ip, user_agent, result, metadata"
+
+// ListAuditEvents отдаёт журнал от новых к старым. Следующая страница
+// запрашивается с before=<next_before>.
+func ListAuditEvents(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		where, args, err := auditFilter(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit должен быть от 1 до 100"})
+			return
+		}
+		args = append(args, limit)
+
+		rows, err := db.Pool.Query(c.Request.Context(),
+			"SELECT "+auditColumns+" FROM audit_events "+where+
+				" ORDER BY id DESC LIMIT $"+strconv.Itoa(len(args)),
+			args...,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		defer rows.Close()
+
+		events := make([]AuditEvent, 0, limit)
+		for rows.Next() {
+			var e AuditEvent
+			if err := rows.Scan(&e.ID, &e.OccurredAt, &e.ActorID, &e.Action, &e.Target, &e.IP, &e.UserAgent, &e.Result, &e.Metadata); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении журнала"})
+				return
+			}
+			events = append(events, e)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении журнала"})
+			return
+		}
+
+		var nextBefore *int64
+		if len(events) == limit {
+			nextBefore = &events[len(events)-1].ID
+		}
+		c.JSON(http.StatusOK, gin.H{"events": events, "next_before": nextBefore})
+	}
+}
+
+// ExportAuditEvents выгружает журнал в JSONL от старых к новым с теми же
+// фильтрами, что и ListAuditEvents, без ограничения по числу строк.
+func ExportAuditEvents(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		where, args, err := auditFilter(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx := c.Request.Context()
+		rows, err := db.Pool.Query(ctx,
+			"SELECT "+auditColumns+" FROM audit_events "+where+" ORDER BY id",
+			args...,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		defer rows.Close()
+
+		audit(c, db, "audit.export", "", auditSuccess, gin.H{"query": c.Request.URL.RawQuery})
+
+		filename := fmt.Sprintf("audit-%s.jsonl", time.Now().UTC().Format("20060102T150405Z"))
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+		c.Status(http.StatusOK)
+
+		encoder := json.NewEncoder(c.Writer)
+		for rows.Next() {
+			var e AuditEvent
+			if err := rows.Scan(&e.ID, &e.OccurredAt, &e.ActorID, &e.Action, &e.Target, &e.IP, &e.UserAgent, &e.Result, &e.Metadata); err != nil {
+				log.Printf("Audit export aborted: %v", err)
+				return
+			}
+			if err := encoder.Encode(e); err != nil {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Audit export aborted: %v", err)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package server
+
+import (
+	"authService/db"
+	"authService/mail"
+	"authService/password"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	emailTokenVerify = "verify"
+	emailTokenReset  = "reset"
+)
+
+// backgroundMailTimeout ограничивает отправку писем, которые уходят
+// уже после ответа клиенту.
+const backgroundMailTimeout = time.Minute
+
+// newEmailToken выдаёт одноразовый токен для письма, отменяя предыдущие
+// неиспользованные токены того же назначения.
+func newEmailToken(ctx context.Context, q querier, userID uuid.UUID, purpose, email string, ttl time.Duration) (string, error) {
+	_, err := q.Exec(ctx,
+		`UPDATE email_tokens
+		 SET used_at = CURRENT_TIMESTAMP
+		 WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL`,
+		userID, purpose,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	raw, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = q.Exec(ctx,
+		`INSERT INTO email_tokens (user_id, purpose, email, token_hash, expires_at)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		userID, purpose, email, hashToken(raw), time.Now().Add(ttl),
+	)
+	if err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// consumeEmailToken помечает токен использованным и возвращает владельца.
+func consumeEmailToken(ctx context.Context, q querier, raw, purpose string) (uuid.UUID, string, error) {
+	var userID uuid.UUID
+	var email string
+	err := q.QueryRow(ctx,
+		`UPDATE email_tokens
+		 SET used_at = CURRENT_TIMESTAMP
+		 WHERE token_hash = $1 AND purpose = $2
+		   AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		 RETURNING user_id, email`,
+		hashToken(raw), purpose,
+	).Scan(&userID, &email)
+	return userID, email, err
+}
+
+func emailLink(appURL, path, token string) string {
+	return strings.TrimRight(appURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+func sendVerificationEmail(ctx context.Context, mailer mail.Mailer, config Config, email, token string) {
+	err := mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Подтверждение адреса электронной почты",
+		Body: fmt.Sprintf("Чтобы подтвердить адрес, перейдите по ссылке:\n\n%s\n\nСсылка действительна %s.",
+			emailLink(config.AppURL, "/verify", token), config.VerifyTokenTTL),
+	})
+	if err != nil {
+		log.Printf("Failed to send verification email: %v", err)
+	}
+}
+
+func SetEmail(db *db.Database, mailer mail.Mailer, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Email string `json:"email" binding:"required,email,max=255"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userID, err := uuid.Parse(c.GetString("user_id"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		email := strings.ToLower(req.Email)
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		// Занятым считается только подтверждённый адрес: заявка без
+		// подтверждения не должна блокировать его владельца.
+		var taken bool
+		err = tx.QueryRow(ctx,
+			`SELECT EXISTS(SELECT 1 FROM auth
+			               WHERE lower(email) = $1 AND user_id <> $2 AND email_verified_at IS NOT NULL)`,
+			email, userID,
+		).Scan(&taken)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if taken {
+			c.JSON(http.StatusConflict, gin.H{"error": "Адрес уже используется"})
+			return
+		}
+
+		_, err = tx.Exec(ctx,
+			`UPDATE auth
+			 SET email = $1,
+			     email_verified_at = CASE WHEN lower(email) = $1 THEN email_verified_at END
+			 WHERE user_id = $2`,
+			email, userID,
+		)
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Адрес уже используется"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при сохранении адреса"})
+			return
+		}
+
+		token, err := newEmailToken(ctx, tx, userID, emailTokenVerify, email, config.VerifyTokenTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании токена"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		sendVerificationEmail(ctx, mailer, config, email, token)
+		audit(c, db, "email.change", userID.String(), auditSuccess, nil)
+		c.JSON(http.StatusAccepted, gin.H{"message": "Письмо для подтверждения отправлено"})
+	}
+}
+
+func VerifyEmail(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		userID, email, err := consumeEmailToken(ctx, tx, req.Token, emailTokenVerify)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Ссылка недействительна или устарела"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		// Адрес могли сменить после отправки письма — тогда старая ссылка ничего не подтверждает.
+		cmdTag, err := tx.Exec(ctx,
+			`UPDATE auth
+			 SET email_verified_at = CURRENT_TIMESTAMP
+			 WHERE user_id = $1 AND lower(email) = lower($2)`,
+			userID, email,
+		)
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Адрес уже подтверждён другим пользователем"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if cmdTag.RowsAffected() == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Ссылка недействительна или устарела"})
+			return
+		}
+
+		// Подтверждённый адрес выигрывает: чужие неподтверждённые заявки
+		// на него снимаются, и их ссылки больше ничего не подтвердят.
+		_, err = tx.Exec(ctx,
+			`UPDATE auth SET email = NULL
+			 WHERE lower(email) = lower($2) AND user_id <> $1 AND email_verified_at IS NULL`,
+			userID, email,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Адрес подтверждён",
+			"email":   email,
+		})
+	}
+}
+
+func ForgotPassword(db *db.Database, mailer mail.Mailer, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Email string `json:"email" binding:"required,email"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Каждый запрос засчитывается, найден адрес или нет: иначе
+		// одним клиентом можно завалить письмами чужой ящик.
+		limits := config.LoginLimits
+		if !acquireThrottled(c, db, limits, map[string]int{
+			resetThrottleKey(req.Email):      limits.MaxFailuresPerLogin,
+			resetIPThrottleKey(c.ClientIP()): limits.MaxFailuresPerIP,
+		}) {
+			return
+		}
+
+		// Ответ одинаковый независимо от того, найден ли адрес,
+		// чтобы по нему нельзя было перебирать зарегистрированные почты.
+		response := gin.H{"message": "Если адрес зарегистрирован, на него отправлено письмо"}
+
+		// Ссылка уходит только на подтверждённый адрес: неподтверждённый
+		// мог указать кто угодно.
+		ctx := c.Request.Context()
+		var userID uuid.UUID
+		var email string
+		err := db.Pool.QueryRow(ctx,
+			`SELECT user_id, email FROM auth
+			 WHERE lower(email) = lower($1) AND email_verified_at IS NOT NULL`,
+			req.Email,
+		).Scan(&userID, &email)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusAccepted, response)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		// Токен и письмо готовятся уже после ответа: иначе по времени
+		// ответа было бы видно, что адрес зарегистрирован.
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), backgroundMailTimeout)
+			defer cancel()
+
+			token, err := newEmailToken(ctx, db.Pool, userID, emailTokenReset, email, config.ResetTokenTTL)
+			if err != nil {
+				log.Printf("Failed to create password reset token for user %s: %v", userID, err)
+				return
+			}
+			err = mailer.Send(ctx, mail.Message{
+				To:      email,
+				Subject: "Восстановление пароля",
+				Body: fmt.Sprintf("Чтобы задать новый пароль, перейдите по ссылке:\n\n%s\n\nСсылка действительна %s. Если вы не запрашивали восстановление, просто проигнорируйте это письмо.",
+					emailLink(config.AppURL, "/password/reset", token), config.ResetTokenTTL),
+			})
+			if err != nil {
+				log.Printf("Failed to send password reset email to user %s: %v", userID, err)
+			}
+		}()
+
+		c.JSON(http.StatusAccepted, response)
+	}
+}
+
+func ResetPassword(db *db.Database, hasher *password.Hasher, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Token    string `json:"token" binding:"required"`
+			Password string `json:"password" binding:"required,max=255"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		userID, email, err := consumeEmailToken(ctx, tx, req.Token, emailTokenReset)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Ссылка недействительна или устарела"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		// При отказе транзакция откатывается, и ссылкой можно воспользоваться снова.
+		var login, username string
+		err = tx.QueryRow(ctx,
+			"SELECT a.login, u.username FROM auth a JOIN users u ON u.id = a.user_id WHERE a.user_id = $1",
+			userID,
+		).Scan(&login, &username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !checkPassword(c, config.PasswordPolicy, req.Password, login, username) {
+			return
+		}
+
+		hash, err := hasher.Hash(req.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Не удалось обработать пароль"})
+			return
+		}
+
+		// Письмо дошло до владельца адреса, значит адрес заодно подтверждён.
+		_, err = tx.Exec(ctx,
+			`UPDATE auth
+			 SET password = $1,
+			     tokens_valid_after = $4,
+			     email_verified_at = CASE WHEN lower(email) = lower($3)
+			                              THEN COALESCE(email_verified_at, CURRENT_TIMESTAMP)
+			                              ELSE email_verified_at END
+			 WHERE user_id = $2`,
+			hash, userID, email, time.Now(),
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при сохранении пароля"})
+			return
+		}
+
+		if _, err := revokeUserSessions(ctx, tx, userID.String()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при завершении сессий"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		auditAs(c, db, userID.String(), "password.reset", userID.String(), auditSuccess, nil)
+		c.JSON(http.StatusOK, gin.H{"message": "Пароль изменён, войдите заново"})
+	}
+}
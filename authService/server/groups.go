@@ -0,0 +1,418 @@
+package server
+
+import (
+	"authService/db"
+	"authService/outbox"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// openGroupID — группа «Все пользователи», в которую попадает каждый при регистрации.
+const openGroupID = "00000000-0000-0000-0000-000000000000"
+
+const maxPageLimit = 100
+
+type Group struct {
+	ID          uuid.UUID `json:"id"`
+	Name        string    `json:"name"`
+	MemberCount int64     `json:"member_count"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// pagination разбирает limit/offset из query и проверяет границы.
+func pagination(c *gin.Context) (int, int, bool) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit должен быть от 1 до " + strconv.Itoa(maxPageLimit)})
+		return 0, 0, false
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset должен быть неотрицательным"})
+		return 0, 0, false
+	}
+	return limit, offset, true
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+func ListGroups(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, offset, ok := pagination(c)
+		if !ok {
+			return
+		}
+
+		rows, err := db.Pool.Query(c.Request.Context(),
+			`SELECT g.id, g.name, g.created_at,
+			        (SELECT count(*) FROM user_group ug WHERE ug.group_id = g.id)
+			 FROM groups g
+			 ORDER BY g.created_at, g.id
+			 LIMIT $1 OFFSET $2`,
+			limit, offset,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		defer rows.Close()
+
+		groups := make([]Group, 0)
+		for rows.Next() {
+			var g Group
+			if err := rows.Scan(&g.ID, &g.Name, &g.CreatedAt, &g.MemberCount); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении групп"})
+				return
+			}
+			groups = append(groups, g)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении групп"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"groups": groups,
+			"count":  len(groups),
+		})
+	}
+}
+
+func CreateGroup(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Name string `json:"name" binding:"required,max=50"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var g Group
+		err := db.Pool.QueryRow(c.Request.Context(),
+			"INSERT INTO groups (name) VALUES ($1) RETURNING id, name, created_at",
+			req.Name,
+		).Scan(&g.ID, &g.Name, &g.CreatedAt)
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Группа с таким названием уже существует"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании группы"})
+			return
+		}
+
+		audit(c, db, "group.create", g.ID.String(), auditSuccess, gin.H{"name": g.Name})
+		c.JSON(http.StatusCreated, gin.H{"group": g})
+	}
+}
+
+func RenameGroup(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Name string `json:"name" binding:"required,max=50"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		groupID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор группы"})
+			return
+		}
+
+		var g Group
+		err = db.Pool.QueryRow(c.Request.Context(),
+			`UPDATE groups SET name = $1 WHERE id = $2
+			 RETURNING id, name, created_at,
+			           (SELECT count(*) FROM user_group ug WHERE ug.group_id = groups.id)`,
+			req.Name, groupID,
+		).Scan(&g.ID, &g.Name, &g.CreatedAt, &g.MemberCount)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Группа не найдена"})
+			return
+		}
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Группа с таким названием уже существует"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при переименовании группы"})
+			return
+		}
+
+		audit(c, db, "group.rename", g.ID.String(), auditSuccess, gin.H{"name": g.Name})
+		c.JSON(http.StatusOK, gin.H{"group": g})
+	}
+}
+
+func DeleteGroup(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор группы"})
+			return
+		}
+		if groupID.String() == openGroupID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Нельзя удалить группу «Все пользователи»"})
+			return
+		}
+
+		cmdTag, err := db.Pool.Exec(c.Request.Context(), "DELETE FROM groups WHERE id = $1", groupID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при удалении группы"})
+			return
+		}
+		if cmdTag.RowsAffected() == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Группа не найдена"})
+			return
+		}
+
+		audit(c, db, "group.delete", groupID.String(), auditSuccess, nil)
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "Группа удалена",
+			"group_id": groupID.String(),
+		})
+	}
+}
+
+func GetGroupMembers(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор группы"})
+			return
+		}
+		limit, offset, ok := pagination(c)
+		if !ok {
+			return
+		}
+
+		var total int64
+		err = db.Pool.QueryRow(c.Request.Context(),
+			`SELECT count(ug.user_id)
+			 FROM groups g
+			 LEFT JOIN user_group ug ON ug.group_id = g.id
+			 WHERE g.id = $1
+			 GROUP BY g.id`,
+			groupID,
+		).Scan(&total)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Группа не найдена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		rows, err := db.Pool.Query(c.Request.Context(),
+			`SELECT u.id, u.username
+			 FROM user_group ug
+			 JOIN users u ON u.id = ug.user_id
+			 WHERE ug.group_id = $1
+			 ORDER BY u.username, u.id
+			 LIMIT $2 OFFSET $3`,
+			groupID, limit, offset,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		defer rows.Close()
+
+		members := []gin.H{}
+		for rows.Next() {
+			var id uuid.UUID
+			var username string
+			if err := rows.Scan(&id, &username); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении участников"})
+				return
+			}
+			members = append(members, gin.H{"id": id.String(), "username": username})
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении участников"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"members": members,
+			"count":   len(members),
+			"total":   total,
+		})
+	}
+}
+
+func AddGroupMembers(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			UserIDs []uuid.UUID `json:"user_ids" binding:"required,min=1,max=100"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		groupID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор группы"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var exists bool
+		err = tx.QueryRow(ctx,
+			"SELECT EXISTS(SELECT 1 FROM groups WHERE id = $1)", groupID,
+		).Scan(&exists)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Группа не найдена"})
+			return
+		}
+
+		added, err := changeMembers(ctx, tx,
+			`INSERT INTO user_group (user_id, group_id)
+			 SELECT u.id, $1 FROM users u WHERE u.id = ANY($2::uuid[])
+			 ON CONFLICT DO NOTHING
+			 RETURNING user_id`,
+			groupID, req.UserIDs, outbox.TypeGroupMembersAdded,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при добавлении участников"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		audit(c, db, "group.members_add", groupID.String(), auditSuccess, gin.H{"user_ids": req.UserIDs, "added": added})
+		c.JSON(http.StatusOK, gin.H{"added": added})
+	}
+}
+
+func RemoveGroupMembers(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			UserIDs []uuid.UUID `json:"user_ids" binding:"required,min=1,max=100"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		groupID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор группы"})
+			return
+		}
+		if groupID.String() == openGroupID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Из группы «Все пользователи» нельзя исключить"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		removed, err := changeMembers(ctx, tx,
+			"DELETE FROM user_group WHERE group_id = $1 AND user_id = ANY($2::uuid[]) RETURNING user_id",
+			groupID, req.UserIDs, outbox.TypeGroupMembersRemoved,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при удалении участников"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		audit(c, db, "group.members_remove", groupID.String(), auditSuccess, gin.H{"user_ids": req.UserIDs, "removed": removed})
+		c.JSON(http.StatusOK, gin.H{"removed": removed})
+	}
+}
+
+// changeMembers выполняет запрос, возвращающий затронутых user_id, и пишет
+// событие о фактически изменённых участниках. Возвращает их число.
+func changeMembers(ctx context.Context, tx pgx.Tx, sql string, groupID uuid.UUID, userIDs []uuid.UUID, eventType string) (int, error) {
+	rows, err := tx.Query(ctx, sql, groupID, userIDs)
+	if err != nil {
+		return 0, err
+	}
+	changed, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil || len(changed) == 0 {
+		return 0, err
+	}
+
+	err = outbox.Enqueue(ctx, tx, eventType, outbox.GroupMembersChanged{GroupID: groupID, UserIDs: changed})
+	return len(changed), err
+}
+
+func GetUserGroups(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор пользователя"})
+			return
+		}
+
+		rows, err := db.Pool.Query(c.Request.Context(),
+			`SELECT g.id, g.name, g.created_at
+			 FROM user_group ug
+			 JOIN groups g ON g.id = ug.group_id
+			 WHERE ug.user_id = $1
+			 ORDER BY g.name`,
+			userID,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		defer rows.Close()
+
+		groups := make([]Group, 0)
+		for rows.Next() {
+			var g Group
+			if err := rows.Scan(&g.ID, &g.Name, &g.CreatedAt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении групп"})
+				return
+			}
+			groups = append(groups, g)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении групп"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"groups": groups})
+	}
+}
@@ -2,20 +2,30 @@ package server
 
 import (
 	"authService/db"
+	"authService/mail"
+	"authService/outbox"
+	"authService/password"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
-func Register(db *db.Database) gin.HandlerFunc {
+func Register(db *db.Database, hasher *password.Hasher, mailer mail.Mailer, config Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
 			Username string `json:"username" binding:"required,max=50"`
 			Login    string `json:"login" binding:"required,max=255"`
 			Password string `json:"password" binding:"required,max=255"`
+			Email    string `json:"email" binding:"omitempty,email,max=255"`
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -23,19 +33,32 @@ func Register(db *db.Database) gin.HandlerFunc {
 			return
 		}
 
-		var exists bool
-		err := db.Pool.QueryRow(c.Request.Context(),
-			"SELECT EXISTS(SELECT 1 FROM auth WHERE login = $1 AND password = $2)",
-			req.Login, req.Password,
-		).Scan(&exists)
+		if !checkPassword(c, config.PasswordPolicy, req.Password, req.Username, req.Login, req.Email) {
+			return
+		}
 
-		if err != nil {
+		var email *string
+		if req.Email != "" {
+			lower := strings.ToLower(req.Email)
+			email = &lower
+		}
+
+		switch err := checkRegistration(c.Request.Context(), db.Pool, req.Login, email); {
+		case errors.Is(err, errLoginTaken):
+			audit(c, db, "user.register", "", auditFailure, gin.H{"reason": "login_taken"})
+			c.JSON(http.StatusConflict, gin.H{"error": "Username already taken"})
+			return
+		case errors.Is(err, errEmailTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": "Адрес уже используется"})
+			return
+		case err != nil:
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 			return
 		}
 
-		if exists {
-			c.JSON(http.StatusConflict, gin.H{"error": "Username already taken"})
+		hash, err := hasher.Hash(req.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Не удалось обработать пароль"})
 			return
 		}
 
@@ -47,34 +70,42 @@ func Register(db *db.Database) gin.HandlerFunc {
 		}
 		defer tx.Rollback(c.Request.Context())
 
-		_, err = tx.Exec(c.Request.Context(),
-			"INSERT INTO users (id, username) VALUES ($1, $2)",
-			userID, req.Username,
-		)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании пользователя"})
+		err = createUser(c.Request.Context(), tx, userID, req.Username, req.Login, hash, email)
+		switch {
+		case errors.Is(err, errUsernameTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": "Имя пользователя занято"})
+			return
+		case errors.Is(err, errLoginTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": "Username already taken"})
+			return
+		case errors.Is(err, errEmailTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": "Адрес уже используется"})
 			return
 		}
-		_, err = tx.Exec(c.Request.Context(),
-			"INSERT INTO auth (user_id, login, password) VALUES ($1, $2, $3)",
-			userID, req.Login, req.Password,
-		)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при сохранении пароля"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании пользователя"})
 			return
 		}
-		_, _ = tx.Exec(c.Request.Context(),
-			`INSERT INTO user_group (user_id, group_id) 
-			 VALUES ($1, '00000000-0000-0000-0000-000000000000')
-			 ON CONFLICT DO NOTHING`,
-			userID,
-		)
+
+		var verifyToken string
+		if email != nil {
+			verifyToken, err = newEmailToken(c.Request.Context(), tx, userID, emailTokenVerify, *email, config.VerifyTokenTTL)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании токена"})
+				return
+			}
+		}
 
 		if err := tx.Commit(c.Request.Context()); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
 			return
 		}
 
+		if email != nil {
+			sendVerificationEmail(c.Request.Context(), mailer, config, *email, verifyToken)
+		}
+
+		auditAs(c, db, userID.String(), "user.register", userID.String(), auditSuccess, nil)
 		c.JSON(http.StatusCreated, gin.H{
 			"message":  "Регистрация прошла успешно",
 			"user_id":  userID.String(),
@@ -83,11 +114,12 @@ func Register(db *db.Database) gin.HandlerFunc {
 	}
 }
 
-func Login(db *db.Database, jwtSecret string) gin.HandlerFunc {
+func Login(db *db.Database, tokens *TokenIssuer, hasher *password.Hasher, limits LoginLimits) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
-			Login    string `json:"login" binding:"required"`
-			Password string `json:"password" binding:"required"`
+			Login      string `json:"login" binding:"required,max=255"`
+			Password   string `json:"password" binding:"required"`
+			DeviceName string `json:"device_name" binding:"max=100"`
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -95,144 +127,646 @@ func Login(db *db.Database, jwtSecret string) gin.HandlerFunc {
 			return
 		}
 
+		ctx := c.Request.Context()
+		loginKey := loginThrottleKey(req.Login)
+		ipKey := ipThrottleKey(c.ClientIP())
+		retryAfter, err := acquireLoginAttempts(ctx, db.Pool, limits, map[string]int{
+			loginKey: limits.MaxFailuresPerLogin,
+			ipKey:    limits.MaxFailuresPerIP,
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if retryAfter > 0 {
+			audit(c, db, "auth.login", "", auditDenied, gin.H{"reason": "throttled"})
+			respondThrottled(c, retryAfter, "Слишком много попыток входа, попробуйте позже")
+			return
+		}
+
+		// Неизвестный логин и неверный пароль дают одинаковый ответ,
+		// чтобы по нему нельзя было перебирать существующие логины.
+		// Попытка уже засчитана в acquireLoginAttempts.
+		loginFailed := func(userID, reason string) {
+			auditAs(c, db, userID, "auth.login", userID, auditFailure, gin.H{"reason": reason})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверный логин или пароль"})
+		}
+
 		var userID uuid.UUID
-		var password string
+		var storedPassword string
 		var username string
-		err := db.Pool.QueryRow(c.Request.Context(),
+		err = db.Pool.QueryRow(ctx,
 			`SELECT a.user_id, a.password, u.username
 			 FROM auth a
 			 JOIN users u ON a.user_id = u.id
 			 WHERE a.login = $1`,
 			req.Login,
-		).Scan(&userID, &password, &username)
+		).Scan(&userID, &storedPassword, &username)
+		if errors.Is(err, pgx.ErrNoRows) {
+			hasher.VerifyDummy(req.Password)
+			loginFailed("", "unknown_login")
+			return
+		}
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверный логин"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 			return
 		}
 
-		if password != req.Password {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверный пароль"})
+		ok, needsRehash, err := hasher.Verify(req.Password, storedPassword)
+		if err != nil {
+			log.Printf("Failed to verify password for user %s: %v", userID, err)
+		}
+		if !ok {
+			loginFailed(userID.String(), "bad_password")
 			return
 		}
 
-		rows, err := db.Pool.Query(c.Request.Context(),
-			`SELECT ug.group_id
-			 FROM user_group ug
-			 WHERE ug.user_id = $1`,
-			userID,
+		if err := resetLoginFailures(ctx, db.Pool, loginKey); err != nil {
+			log.Printf("Failed to reset login failures for user %s: %v", userID, err)
+		}
+		if err := releaseLoginAttempt(ctx, db.Pool, ipKey, limits.MaxFailuresPerIP); err != nil {
+			log.Printf("Failed to release login attempt: %v", err)
+		}
+
+		if needsRehash {
+			if hash, err := hasher.Hash(req.Password); err != nil {
+				log.Printf("Failed to rehash password for user %s: %v", userID, err)
+			} else if _, err := db.Pool.Exec(c.Request.Context(),
+				"UPDATE auth SET password = $1 WHERE user_id = $2 AND password = $3",
+				hash, userID, storedPassword,
+			); err != nil {
+				log.Printf("Failed to store rehashed password for user %s: %v", userID, err)
+			}
+		}
+
+		twoFactor, err := twoFactorEnabled(c.Request.Context(), db.Pool, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if twoFactor {
+			challenge, err := newLoginChallenge(c.Request.Context(), db.Pool, userID, req.DeviceName)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании запроса 2FA"})
+				return
+			}
+			auditAs(c, db, userID.String(), "auth.login_challenge", userID.String(), auditSuccess, nil)
+			c.JSON(http.StatusOK, gin.H{
+				"message":             "Требуется код двухфакторной аутентификации",
+				"two_factor_required": true,
+				"challenge_token":     challenge,
+				"expires_in":          int(loginChallengeTTL.Seconds()),
+			})
+			return
+		}
+
+		completeLogin(c, db, tokens, userID, username, req.DeviceName)
+	}
+}
+
+// completeLogin создаёт сессию и выдаёт пару токенов после успешной
+// проверки всех факторов.
+func completeLogin(c *gin.Context, db *db.Database, tokens *TokenIssuer, userID uuid.UUID, username, deviceName string) {
+	groups, err := userGroups(c.Request.Context(), db.Pool, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении групп"})
+		return
+	}
+
+	access, err := userAccess(c.Request.Context(), db.Pool, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении ролей"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	sessionID, err := createSession(ctx, tx, userID, deviceName, c, time.Now().Add(tokens.RefreshTTL))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании сессии"})
+		return
+	}
+
+	_, refreshToken, err := tokens.NewRefreshToken(ctx, tx, userID, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при выдаче токена"})
+		return
+	}
+
+	tokenString, err := tokens.AccessToken(userID, sessionID, username, groups, access)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при выдаче токена"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+		return
+	}
+
+	auditAs(c, db, userID.String(), "auth.login", userID.String(), auditSuccess,
+		gin.H{"session_id": sessionID.String(), "device_name": deviceName})
+	c.JSON(http.StatusOK, gin.H{
+		"message":                   "Login successful",
+		"user_id":                   userID.String(),
+		"username":                  username,
+		"groups":                    groups,
+		"roles":                     access.Roles,
+		"two_factor_setup_required": access.TwoFactorRequired,
+		"session_id":                sessionID.String(),
+		"token":                     tokenString,
+		"expires_in":                int(tokens.AccessTTL.Seconds()),
+		"refresh_token":             refreshToken,
+	})
+}
+
+func Refresh(db *db.Database, tokens *TokenIssuer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			RefreshToken string `json:"refresh_token" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var tokenID, userID, familyID uuid.UUID
+		var expiresAt time.Time
+		var rotatedAt, revokedAt *time.Time
+		err = tx.QueryRow(ctx,
+			`SELECT id, user_id, family_id, expires_at, rotated_at, revoked_at
+			 FROM refresh_tokens
+			 WHERE token_hash = $1
+			 FOR UPDATE`,
+			hashToken(req.RefreshToken),
+		).Scan(&tokenID, &userID, &familyID, &expiresAt, &rotatedAt, &revokedAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			audit(c, db, "auth.refresh", "", auditFailure, gin.H{"reason": "unknown_token"})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Недействительный refresh-токен"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		if rotatedAt != nil || revokedAt != nil {
+			auditAs(c, db, userID.String(), "auth.refresh", familyID.String(), auditDenied, gin.H{"reason": "token_reuse"})
+			// Повторное использование уже заменённого токена: считаем, что
+			// семейство скомпрометировано, и отзываем его целиком.
+			err = revokeSession(ctx, tx, familyID)
+			if err == nil {
+				err = tx.Commit(ctx)
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			log.Printf("Refresh token reuse detected for user %s, family %s revoked", userID, familyID)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Недействительный refresh-токен"})
+			return
+		}
+
+		if time.Now().After(expiresAt) {
+			auditAs(c, db, userID.String(), "auth.refresh", familyID.String(), auditFailure, gin.H{"reason": "expired"})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Срок действия refresh-токена истёк"})
+			return
+		}
+
+		newID, refreshToken, err := tokens.NewRefreshToken(ctx, tx, userID, familyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при выдаче токена"})
+			return
+		}
+
+		_, err = tx.Exec(ctx,
+			`UPDATE sessions
+			 SET last_seen_at = CURRENT_TIMESTAMP, expires_at = $2, ip = $3
+			 WHERE id = $1`,
+			familyID, time.Now().Add(tokens.RefreshTTL), c.ClientIP(),
 		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		_, err = tx.Exec(ctx,
+			`UPDATE refresh_tokens
+			 SET rotated_at = CURRENT_TIMESTAMP, replaced_by = $1
+			 WHERE id = $2`,
+			newID, tokenID,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		var username string
+		err = tx.QueryRow(ctx, "SELECT username FROM users WHERE id = $1", userID).Scan(&username)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Пользователь не найден"})
+			return
+		}
+
+		groups, err := userGroups(ctx, tx, userID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении групп"})
 			return
 		}
-		defer rows.Close()
-		var groups []uuid.UUID
-		for rows.Next() {
-			var groupID uuid.UUID
-			if err := rows.Scan(&groupID); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки групп"})
+
+		access, err := userAccess(ctx, tx, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при получении ролей"})
+			return
+		}
+
+		tokenString, err := tokens.AccessToken(userID, familyID, username, groups, access)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при выдаче токена"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		auditAs(c, db, userID.String(), "auth.refresh", familyID.String(), auditSuccess, nil)
+		c.JSON(http.StatusOK, gin.H{
+			"user_id":       userID.String(),
+			"username":      username,
+			"groups":        groups,
+			"roles":         access.Roles,
+			"session_id":    familyID.String(),
+			"token":         tokenString,
+			"expires_in":    int(tokens.AccessTTL.Seconds()),
+			"refresh_token": refreshToken,
+		})
+	}
+}
+
+func Logout(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			groups = append(groups, groupID)
 		}
 
-		if err = rows.Err(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении групп"})
+		claims := c.MustGet("claims").(*Claims)
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
 			return
 		}
+		defer tx.Rollback(ctx)
 
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"user_id":  userID.String(),
-			"username": username,
-			"groups":   groups,
-			"exp":      time.Now().Add(24 * time.Hour).Unix(),
-		})
+		_, err = tx.Exec(ctx,
+			`INSERT INTO revoked_tokens (jti, user_id, expires_at)
+			 VALUES ($1, $2, $3)
+			 ON CONFLICT (jti) DO NOTHING`,
+			claims.ID, claims.UserID, claims.ExpiresAt.Time,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при отзыве токена"})
+			return
+		}
+
+		if claims.SessionID != "" {
+			sessionID, err := uuid.Parse(claims.SessionID)
+			if err == nil {
+				err = revokeSession(ctx, tx, sessionID)
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при отзыве токена"})
+				return
+			}
+		}
+
+		if req.RefreshToken != "" {
+			_, err = tx.Exec(ctx,
+				`UPDATE refresh_tokens
+				 SET revoked_at = CURRENT_TIMESTAMP
+				 WHERE revoked_at IS NULL
+				   AND user_id = $2
+				   AND family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1)`,
+				hashToken(req.RefreshToken), claims.UserID,
+			)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при отзыве токена"})
+				return
+			}
+		}
 
-		tokenString, err := token.SignedString([]byte(jwtSecret))
+		_, _ = tx.Exec(ctx, "DELETE FROM revoked_tokens WHERE expires_at < CURRENT_TIMESTAMP")
 
-		var dbtoken string
-		err = db.Pool.QueryRow(c.Request.Context(),
-			`UPDATE auth
-			SET jwt = $1
-			WHERE user_id = $2
-			RETURNING jwt`,
-			tokenString, userID,
-		).Scan(&dbtoken)
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		audit(c, db, "auth.logout", claims.SessionID, auditSuccess, nil)
+		c.JSON(http.StatusOK, gin.H{"message": "Сеанс завершён"})
+	}
+}
+
+func LogoutAll(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		_, err = tx.Exec(ctx,
+			"UPDATE auth SET tokens_valid_after = $2 WHERE user_id = $1",
+			userID, time.Now(),
+		)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при отзыве токенов"})
 			return
 		}
 
-		if dbtoken != tokenString {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "dbtoken!=tokenstring"})
+		revokedSessions, err := revokeUserSessions(ctx, tx, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при отзыве токенов"})
+			return
 		}
 
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		audit(c, db, "auth.logout_all", userID, auditSuccess, gin.H{"revoked_sessions": revokedSessions})
 		c.JSON(http.StatusOK, gin.H{
-			"message":  "Login successful",
-			"user_id":  userID.String(),
-			"username": username,
-			"groups":   groups,
-			"token":    tokenString,
+			"message":          "Все сеансы завершены",
+			"revoked_sessions": revokedSessions,
 		})
 	}
 }
 
-func GetUser(db *db.Database) gin.HandlerFunc {
+// Introspect используется другими сервисами, чтобы узнать, не отозван ли токен;
+// доступен только по токену сервиса.
+// В журнал аудита не пишется: это служебный запрос на каждый вызов chatService.
+func Introspect(db *db.Database, tokens *TokenIssuer) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID := c.Param("id")
+		var req struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-		var username string
-		var createdAt time.Time
-		err := db.Pool.QueryRow(c.Request.Context(),
-			"SELECT username, created_at FROM users WHERE id = $1",
-			userID,
-		).Scan(&username, &createdAt)
+		claims, err := tokens.Parse(req.Token)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"active": false})
+			return
+		}
 
+		revoked, err := tokenRevoked(c.Request.Context(), db.Pool, claims)
 		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
-			"id":         userID,
-			"username":   username,
-			"created_at": createdAt.Format(time.RFC3339),
+			"active":  !revoked,
+			"jti":     claims.ID,
+			"user_id": claims.UserID,
+			"exp":     claims.ExpiresAt.Unix(),
 		})
 	}
 }
 
-func DeleteUser(db *db.Database) gin.HandlerFunc {
+func JWKS(tokens *TokenIssuer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, gin.H{"keys": tokens.keys.JWKS()})
+	}
+}
+
+func GetUser(db *db.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID := c.Param("id")
+		userID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		profile, err := loadProfile(c.Request.Context(), db.Pool, userID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		c.JSON(http.StatusOK, profile.Public())
+	}
+}
 
-		_, err := db.Pool.Exec(c.Request.Context(),
-			"DELETE FROM users WHERE id = $1",
-			userID,
+func DeleteUser(db *db.Database, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор пользователя"})
+			return
+		}
+
+		// Удалить себя может любой, других — только с правом users:delete.
+		if userID.String() != c.GetString("user_id") && !hasPermission(c, PermUsersDelete) {
+			audit(c, db, "user.delete", userID.String(), auditDenied, nil)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Недостаточно прав"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		if err := ensureNotLastAdmin(ctx, tx, userID); err != nil {
+			if errors.Is(err, errLastAdmin) {
+				audit(c, db, "user.delete", userID.String(), auditFailure, gin.H{"reason": "last_admin"})
+				c.JSON(http.StatusConflict, gin.H{"error": "Нельзя удалить последнего администратора"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		// Имя удалённого пользователя тоже удерживается, чтобы его не занял
+		// кто-то, выдающий себя за него.
+		cmdTag, err := tx.Exec(ctx,
+			`WITH deleted AS (
+				DELETE FROM users WHERE id = $1 RETURNING username
+			 )
+			 INSERT INTO username_history (user_id, username, reserved_until)
+			 SELECT NULL, username, $2 FROM deleted`,
+			userID, time.Now().Add(config.UsernameHold),
 		)
 
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
 			return
 		}
+		if cmdTag.RowsAffected() == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		// chatService узнает об удалении из outbox и сотрёт членства и сообщения.
+		if err := outbox.Enqueue(ctx, tx, outbox.TypeUserDeleted, outbox.UserDeleted{UserID: userID}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при записи события"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
 
+		audit(c, db, "user.delete", userID.String(), auditSuccess, nil)
 		c.JSON(http.StatusOK, gin.H{
 			"message": "Пользователь удалён",
-			"user_id": userID,
+			"user_id": userID.String(),
 		})
 	}
 }
 
+type userCursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        uuid.UUID `json:"id"`
+}
+
+func encodeUserCursor(createdAt time.Time, id uuid.UUID) string {
+	b, _ := json.Marshal(userCursor{CreatedAt: createdAt, ID: id})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeUserCursor(s string) (userCursor, error) {
+	var cur userCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, err
+	}
+	err = json.Unmarshal(b, &cur)
+	return cur, err
+}
+
+// directoryPageLimit — справочник отдаёт людей небольшими страницами:
+// он нужен, чтобы найти собеседника, а не выгрузить всех пользователей.
+const directoryPageLimit = 20
+
+// ListUsers — полный список пользователей с логинами и почтой для
+// обладателей users:list.
 func ListUsers(db *db.Database) gin.HandlerFunc {
+	return listUsers(db, false)
+}
+
+// SearchDirectory — справочник для выбора собеседников: только
+// публичные поля и только по поисковому запросу.
+func SearchDirectory(db *db.Database) gin.HandlerFunc {
+	return listUsers(db, true)
+}
+
+// listUsers ищет пользователей по имени с keyset-пагинацией по
+// (created_at, id). Поиск: mode=prefix (по умолчанию) или mode=fuzzy
+// через pg_trgm.
+func listUsers(db *db.Database, directory bool) gin.HandlerFunc {
+	maxLimit := maxPageLimit
+	if directory {
+		maxLimit = directoryPageLimit
+	}
 	return func(c *gin.Context) {
-		limit := c.DefaultQuery("limit", "50")
-		offset := c.DefaultQuery("offset", "0")
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(min(50, maxLimit))))
+		if err != nil || limit < 1 || limit > maxLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit должен быть от 1 до " + strconv.Itoa(maxLimit)})
+			return
+		}
+		if directory && strings.TrimSpace(c.Query("q")) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Нужен поисковый запрос q"})
+			return
+		}
+
+		conditions := []string{"TRUE"}
+		var args []any
+		arg := func(v any) string {
+			args = append(args, v)
+			return "$" + strconv.Itoa(len(args))
+		}
+
+		if q := strings.TrimSpace(c.Query("q")); q != "" {
+			switch c.DefaultQuery("mode", "prefix") {
+			case "prefix":
+				escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(q))
+				conditions = append(conditions, "lower(u.username) LIKE "+arg(escaped+"%"))
+			case "fuzzy":
+				conditions = append(conditions, "u.username % "+arg(q))
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": "mode должен быть prefix или fuzzy"})
+				return
+			}
+		}
+
+		if group := c.Query("group"); group != "" {
+			groupID, err := uuid.Parse(group)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор группы"})
+				return
+			}
+			conditions = append(conditions,
+				"EXISTS(SELECT 1 FROM user_group ug WHERE ug.user_id = u.id AND ug.group_id = "+arg(groupID)+")")
+		}
 
+		if cursor := c.Query("cursor"); cursor != "" {
+			cur, err := decodeUserCursor(cursor)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный cursor"})
+				return
+			}
+			conditions = append(conditions, "(u.created_at, u.id) < ("+arg(cur.CreatedAt)+", "+arg(cur.ID)+")")
+		}
+
+		private := !directory
 		rows, err := db.Pool.Query(c.Request.Context(),
-			`SELECT id, username, created_at 
-			 FROM users 
-			 ORDER BY created_at DESC 
-			 LIMIT $1 OFFSET $2`,
-			limit, offset,
+			`SELECT u.id, u.username, u.created_at, a.login, a.email
+			 FROM users u
+			 LEFT JOIN auth a ON a.user_id = u.id
+			 WHERE `+strings.Join(conditions, " AND ")+`
+			 ORDER BY u.created_at DESC, u.id DESC
+			 LIMIT `+arg(limit+1),
+			args...,
 		)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -240,26 +774,58 @@ func ListUsers(db *db.Database) gin.HandlerFunc {
 		}
 		defer rows.Close()
 
-		users := []gin.H{}
+		type row struct {
+			id        uuid.UUID
+			username  string
+			createdAt time.Time
+			login     *string
+			email     *string
+		}
+		var found []row
 		for rows.Next() {
-			var id uuid.UUID
-			var username string
-			var createdAt time.Time
-
-			if err := rows.Scan(&id, &username, &createdAt); err != nil {
-				continue
+			var r row
+			if err := rows.Scan(&r.id, &r.username, &r.createdAt, &r.login, &r.email); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении пользователей"})
+				return
 			}
+			found = append(found, r)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении пользователей"})
+			return
+		}
 
-			users = append(users, gin.H{
-				"id":         id.String(),
-				"username":   username,
-				"created_at": createdAt.Format(time.RFC3339),
-			})
+		var nextCursor *string
+		if len(found) > limit {
+			found = found[:limit]
+			last := found[len(found)-1]
+			next := encodeUserCursor(last.createdAt, last.id)
+			nextCursor = &next
 		}
 
+		users := make([]gin.H, 0, len(found))
+		for _, r := range found {
+			user := gin.H{
+				"id":         r.id.String(),
+				"username":   r.username,
+				"created_at": r.createdAt.Format(time.RFC3339),
+			}
+			if private {
+				user["login"] = r.login
+				user["email"] = r.email
+			}
+			users = append(users, user)
+		}
+
+		// Поиск по справочнику не журналируется, а выдача логинов и
+		// адресов — да.
+		if private {
+			audit(c, db, "users.list", "", auditSuccess, gin.H{"query": c.Request.URL.RawQuery, "count": len(users)})
+		}
 		c.JSON(http.StatusOK, gin.H{
-			"users": users,
-			"count": len(users),
+			"users":       users,
+			"count":       len(users),
+			"next_cursor": nextCursor,
 		})
 	}
 }
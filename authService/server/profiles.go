@@ -0,0 +1,251 @@
+package server
+
+import (
+	"authService/db"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/text/language"
+)
+
+const (
+	maxDisplayNameLength = 100
+	maxBioLength         = 500
+	maxAvatarLength      = 2048
+)
+
+// blobRefPattern — ссылка на загруженный файл во внутреннем хранилище.
+var blobRefPattern = regexp.MustCompile(`^blob:[A-Za-z0-9._-]{1,200}$`)
+
+type Profile struct {
+	ID          uuid.UUID
+	Username    string
+	IsService   bool
+	CreatedAt   time.Time
+	DisplayName *string
+	Avatar      *string
+	Bio         *string
+	Locale      *string
+	TimeZone    *string
+	LastSeenAt  *time.Time
+	UpdatedAt   *time.Time
+}
+
+// Public — поля, которые видят все пользователи.
+func (p Profile) Public() gin.H {
+	return gin.H{
+		"id":           p.ID.String(),
+		"username":     p.Username,
+		"is_service":   p.IsService,
+		"display_name": p.DisplayName,
+		"avatar":       p.Avatar,
+		"bio":          p.Bio,
+		"last_seen_at": p.LastSeenAt,
+		"created_at":   p.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// Private — полный профиль для самого пользователя.
+func (p Profile) Private() gin.H {
+	h := p.Public()
+	h["locale"] = p.Locale
+	h["time_zone"] = p.TimeZone
+	h["updated_at"] = p.UpdatedAt
+	return h
+}
+
+func loadProfile(ctx context.Context, q querier, userID uuid.UUID) (Profile, error) {
+	var p Profile
+	err := q.QueryRow(ctx,
+		`SELECT u.id, u.username, u.is_service, u.created_at,
+		        p.display_name, p.avatar, p.bio, p.locale, p.time_zone, p.last_seen_at, p.updated_at
+		 FROM users u
+		 LEFT JOIN profiles p ON p.user_id = u.id
+		 WHERE u.id = $1`,
+		userID,
+	).Scan(&p.ID, &p.Username, &p.IsService, &p.CreatedAt,
+		&p.DisplayName, &p.Avatar, &p.Bio, &p.Locale, &p.TimeZone, &p.LastSeenAt, &p.UpdatedAt)
+	return p, err
+}
+
+// BatchUsers отдаёт публичные профили пачкой для других сервисов.
+func BatchUsers(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			IDs []uuid.UUID `json:"ids" binding:"required,max=100"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		rows, err := db.Pool.Query(c.Request.Context(),
+			`SELECT u.id, u.username, u.is_service, u.created_at,
+			        p.display_name, p.avatar, p.bio, p.last_seen_at
+			 FROM users u
+			 LEFT JOIN profiles p ON p.user_id = u.id
+			 WHERE u.id = ANY($1)`,
+			req.IDs,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		defer rows.Close()
+
+		found := make(map[uuid.UUID]bool, len(req.IDs))
+		users := make([]gin.H, 0, len(req.IDs))
+		for rows.Next() {
+			var p Profile
+			if err := rows.Scan(&p.ID, &p.Username, &p.IsService, &p.CreatedAt,
+				&p.DisplayName, &p.Avatar, &p.Bio, &p.LastSeenAt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении пользователей"})
+				return
+			}
+			found[p.ID] = true
+			users = append(users, p.Public())
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении пользователей"})
+			return
+		}
+
+		missing := make([]uuid.UUID, 0)
+		for _, id := range req.IDs {
+			if !found[id] {
+				missing = append(missing, id)
+				found[id] = true
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"users": users, "missing": missing})
+	}
+}
+
+func GetMe(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := uuid.Parse(c.GetString("user_id"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		profile, err := loadProfile(c.Request.Context(), db.Pool, userID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		c.JSON(http.StatusOK, profile.Private())
+	}
+}
+
+// UpdateMe частично обновляет профиль. Пустая строка очищает поле,
+// отсутствующее поле остаётся без изменений.
+func UpdateMe(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			DisplayName *string `json:"display_name"`
+			Avatar      *string `json:"avatar"`
+			Bio         *string `json:"bio"`
+			Locale      *string `json:"locale"`
+			TimeZone    *string `json:"time_zone"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userID, err := uuid.Parse(c.GetString("user_id"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		fields := map[string]string{}
+		if req.DisplayName != nil {
+			name := strings.TrimSpace(*req.DisplayName)
+			if utf8.RuneCountInString(name) > maxDisplayNameLength || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+				fields["display_name"] = "Имя не длиннее 100 символов и без управляющих символов"
+			}
+			req.DisplayName = &name
+		}
+		if req.Avatar != nil && *req.Avatar != "" && !validAvatar(*req.Avatar) {
+			fields["avatar"] = "Нужна ссылка http(s) или blob:<id>"
+		}
+		if req.Bio != nil && utf8.RuneCountInString(*req.Bio) > maxBioLength {
+			fields["bio"] = "Не длиннее 500 символов"
+		}
+		if req.Locale != nil && *req.Locale != "" {
+			tag, err := language.Parse(*req.Locale)
+			if err != nil {
+				fields["locale"] = "Некорректный языковой тег"
+			} else {
+				canonical := tag.String()
+				req.Locale = &canonical
+			}
+		}
+		if req.TimeZone != nil && *req.TimeZone != "" {
+			if _, err := time.LoadLocation(*req.TimeZone); err != nil || *req.TimeZone == "Local" {
+				fields["time_zone"] = "Неизвестный часовой пояс"
+			}
+		}
+		if len(fields) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Ошибка валидации", "fields": fields})
+			return
+		}
+
+		// NULLIF превращает пустую строку в NULL, COALESCE оставляет
+		// нетронутыми поля, которых нет в запросе.
+		ctx := c.Request.Context()
+		_, err = db.Pool.Exec(ctx,
+			`INSERT INTO profiles (user_id, display_name, avatar, bio, locale, time_zone, updated_at)
+			 VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), CURRENT_TIMESTAMP)
+			 ON CONFLICT (user_id) DO UPDATE SET
+				display_name = CASE WHEN $2::text IS NULL THEN profiles.display_name ELSE EXCLUDED.display_name END,
+				avatar       = CASE WHEN $3::text IS NULL THEN profiles.avatar ELSE EXCLUDED.avatar END,
+				bio          = CASE WHEN $4::text IS NULL THEN profiles.bio ELSE EXCLUDED.bio END,
+				locale       = CASE WHEN $5::text IS NULL THEN profiles.locale ELSE EXCLUDED.locale END,
+				time_zone    = CASE WHEN $6::text IS NULL THEN profiles.time_zone ELSE EXCLUDED.time_zone END,
+				updated_at   = CURRENT_TIMESTAMP`,
+			userID, req.DisplayName, req.Avatar, req.Bio, req.Locale, req.TimeZone,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при сохранении профиля"})
+			return
+		}
+
+		profile, err := loadProfile(ctx, db.Pool, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		c.JSON(http.StatusOK, profile.Private())
+	}
+}
+
+func validAvatar(avatar string) bool {
+	if len(avatar) > maxAvatarLength {
+		return false
+	}
+	if blobRefPattern.MatchString(avatar) {
+		return true
+	}
+	u, err := url.Parse(avatar)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
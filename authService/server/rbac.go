@@ -0,0 +1,332 @@
+package server
+
+import (
+	"authService/db"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleUser      = "user"
+)
+
+const (
+	PermUsersList      = "users:list"
+	PermUsersDelete    = "users:delete"
+	PermRolesManage    = "roles:manage"
+	PermGroupsManage   = "groups:manage"
+	PermAccountsUnlock = "accounts:unlock"
+	PermAuditRead      = "audit:read"
+
+	PermServiceAccountsManage = "service_accounts:manage"
+)
+
+// Access — роли и права пользователя, которые попадают в access-токен.
+type Access struct {
+	Roles       []string
+	Permissions []string
+	// TwoFactorRequired выставляется, если часть ролей не выдана,
+	// потому что они требуют включённой 2FA.
+	TwoFactorRequired bool
+}
+
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Requires2FA bool     `json:"requires_2fa"`
+	Permissions []string `json:"permissions"`
+}
+
+// userAccess собирает роли и права пользователя. Роли с requires_2fa
+// учитываются, только если у пользователя включена двухфакторная аутентификация.
+func userAccess(ctx context.Context, q querier, userID uuid.UUID) (Access, error) {
+	rows, err := q.Query(ctx,
+		`SELECT r.name, rp.permission,
+		        r.requires_2fa AND NOT EXISTS(
+		            SELECT 1 FROM user_totp t WHERE t.user_id = ur.user_id AND t.enabled_at IS NOT NULL
+		        )
+		 FROM user_roles ur
+		 JOIN roles r ON r.name = ur.role
+		 LEFT JOIN role_permissions rp ON rp.role = r.name
+		 WHERE ur.user_id = $1
+		 ORDER BY r.name, rp.permission`,
+		userID,
+	)
+	if err != nil {
+		return Access{}, err
+	}
+	defer rows.Close()
+
+	access := Access{Roles: []string{}, Permissions: []string{}}
+	for rows.Next() {
+		var role string
+		var permission *string
+		var blocked bool
+		if err := rows.Scan(&role, &permission, &blocked); err != nil {
+			return Access{}, err
+		}
+		if blocked {
+			access.TwoFactorRequired = true
+			continue
+		}
+		if !slices.Contains(access.Roles, role) {
+			access.Roles = append(access.Roles, role)
+		}
+		if permission != nil && !slices.Contains(access.Permissions, *permission) {
+			access.Permissions = append(access.Permissions, *permission)
+		}
+	}
+	return access, rows.Err()
+}
+
+func hasPermission(c *gin.Context, permission string) bool {
+	claims, ok := c.Get("claims")
+	if !ok {
+		return false
+	}
+	return slices.Contains(claims.(*Claims).Permissions, permission)
+}
+
+// RequirePermission пропускает запрос, только если в токене есть нужное право.
+// Используется после AuthMiddleware.
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasPermission(c, permission) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Недостаточно прав"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// BootstrapAdmin выдаёт роль admin пользователю с указанным логином.
+// Нужен, чтобы в свежей установке появился первый администратор.
+func BootstrapAdmin(ctx context.Context, db *db.Database, login string) error {
+	cmdTag, err := db.Pool.Exec(ctx,
+		`INSERT INTO user_roles (user_id, role)
+		 SELECT user_id, $2 FROM auth WHERE login = $1
+		 ON CONFLICT DO NOTHING`,
+		login, RoleAdmin,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to grant admin role: %w", err)
+	}
+	if cmdTag.RowsAffected() == 0 {
+		var exists bool
+		if err := db.Pool.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM auth WHERE login = $1)", login).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to check bootstrap admin: %w", err)
+		}
+		if !exists {
+			return fmt.Errorf("user with login %q not found", login)
+		}
+	}
+	return nil
+}
+
+func ListRoles(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rows, err := db.Pool.Query(c.Request.Context(),
+			`SELECT r.name, r.description, r.requires_2fa,
+			        COALESCE(array_agg(rp.permission ORDER BY rp.permission)
+			                 FILTER (WHERE rp.permission IS NOT NULL), '{}')
+			 FROM roles r
+			 LEFT JOIN role_permissions rp ON rp.role = r.name
+			 GROUP BY r.name
+			 ORDER BY r.name`,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		defer rows.Close()
+
+		roles := make([]Role, 0)
+		for rows.Next() {
+			var r Role
+			if err := rows.Scan(&r.Name, &r.Description, &r.Requires2FA, &r.Permissions); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении ролей"})
+				return
+			}
+			roles = append(roles, r)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении ролей"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"roles": roles})
+	}
+}
+
+func GetUserRoles(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор пользователя"})
+			return
+		}
+
+		rows, err := db.Pool.Query(c.Request.Context(),
+			`SELECT role, granted_at FROM user_roles WHERE user_id = $1 ORDER BY role`,
+			userID,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		defer rows.Close()
+
+		roles := []gin.H{}
+		for rows.Next() {
+			var role string
+			var grantedAt time.Time
+			if err := rows.Scan(&role, &grantedAt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении ролей"})
+				return
+			}
+			roles = append(roles, gin.H{"role": role, "granted_at": grantedAt.Format(time.RFC3339)})
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении ролей"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"user_id": userID.String(), "roles": roles})
+	}
+}
+
+func AssignRole(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Role string `json:"role" binding:"required,max=50"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		userID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор пользователя"})
+			return
+		}
+
+		var roleExists, userExists bool
+		err = db.Pool.QueryRow(c.Request.Context(),
+			`SELECT EXISTS(SELECT 1 FROM roles WHERE name = $1),
+			        EXISTS(SELECT 1 FROM users WHERE id = $2)`,
+			req.Role, userID,
+		).Scan(&roleExists, &userExists)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !roleExists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Роль не найдена"})
+			return
+		}
+		if !userExists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		_, err = db.Pool.Exec(c.Request.Context(),
+			`INSERT INTO user_roles (user_id, role, granted_by)
+			 VALUES ($1, $2, $3)
+			 ON CONFLICT DO NOTHING`,
+			userID, req.Role, c.GetString("user_id"),
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при назначении роли"})
+			return
+		}
+
+		audit(c, db, "role.assign", userID.String(), auditSuccess, gin.H{"role": req.Role})
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Роль назначена",
+			"user_id": userID.String(),
+			"role":    req.Role,
+		})
+	}
+}
+
+func RevokeRole(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор пользователя"})
+			return
+		}
+		role := c.Param("role")
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		if role == RoleAdmin {
+			if err := ensureNotLastAdmin(ctx, tx, userID); err != nil {
+				if errors.Is(err, errLastAdmin) {
+					audit(c, db, "role.revoke", userID.String(), auditFailure, gin.H{"role": role, "reason": "last_admin"})
+					c.JSON(http.StatusConflict, gin.H{"error": "Нельзя снять роль с последнего администратора"})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+		}
+
+		cmdTag, err := tx.Exec(ctx, "DELETE FROM user_roles WHERE user_id = $1 AND role = $2", userID, role)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при снятии роли"})
+			return
+		}
+		if cmdTag.RowsAffected() == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "У пользователя нет этой роли"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		audit(c, db, "role.revoke", userID.String(), auditSuccess, gin.H{"role": role})
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Роль снята",
+			"user_id": userID.String(),
+			"role":    role,
+		})
+	}
+}
+
+var errLastAdmin = errors.New("last admin")
+
+// ensureNotLastAdmin блокирует строки администраторов до конца транзакции,
+// чтобы два параллельных запроса не сняли роль с двух последних админов.
+func ensureNotLastAdmin(ctx context.Context, q querier, userID uuid.UUID) error {
+	rows, err := q.Query(ctx, "SELECT user_id FROM user_roles WHERE role = $1 FOR UPDATE", RoleAdmin)
+	if err != nil {
+		return err
+	}
+	admins, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return err
+	}
+	if len(admins) == 1 && admins[0] == userID {
+		return errLastAdmin
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"authService/db"
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	DeviceName *string   `json:"device_name"`
+	UserAgent  *string   `json:"user_agent"`
+	IP         *string   `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+func createSession(ctx context.Context, q querier, userID uuid.UUID, deviceName string, c *gin.Context, expiresAt time.Time) (uuid.UUID, error) {
+	var device *string
+	if deviceName != "" {
+		device = &deviceName
+	}
+
+	var sessionID uuid.UUID
+	err := q.QueryRow(ctx,
+		`INSERT INTO sessions (user_id, device_name, user_agent, ip, expires_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING id`,
+		userID, device, c.Request.UserAgent(), c.ClientIP(), expiresAt,
+	).Scan(&sessionID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	_, err = q.Exec(ctx,
+		`INSERT INTO profiles (user_id, last_seen_at)
+		 VALUES ($1, CURRENT_TIMESTAMP)
+		 ON CONFLICT (user_id) DO UPDATE SET last_seen_at = EXCLUDED.last_seen_at`,
+		userID,
+	)
+	return sessionID, err
+}
+
+// revokeSession завершает сессию и отзывает все её refresh-токены.
+// Access-токены сессии отклоняются по claim sid.
+func revokeSession(ctx context.Context, q querier, sessionID uuid.UUID) error {
+	_, err := q.Exec(ctx,
+		`UPDATE sessions
+		 SET revoked_at = CURRENT_TIMESTAMP
+		 WHERE id = $1 AND revoked_at IS NULL`,
+		sessionID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(ctx,
+		`UPDATE refresh_tokens
+		 SET revoked_at = CURRENT_TIMESTAMP
+		 WHERE family_id = $1 AND revoked_at IS NULL`,
+		sessionID,
+	)
+	return err
+}
+
+func revokeUserSessions(ctx context.Context, q querier, userID string) (int64, error) {
+	cmdTag, err := q.Exec(ctx,
+		`UPDATE sessions
+		 SET revoked_at = CURRENT_TIMESTAMP
+		 WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP`,
+		userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	_, err = q.Exec(ctx,
+		`UPDATE refresh_tokens
+		 SET revoked_at = CURRENT_TIMESTAMP
+		 WHERE user_id = $1 AND revoked_at IS NULL`,
+		userID,
+	)
+	return cmdTag.RowsAffected(), err
+}
+
+// touchSession обновляет last_seen_at сессии и профиля не чаще раза в минуту.
+func touchSession(ctx context.Context, q querier, sessionID string) error {
+	_, err := q.Exec(ctx,
+		`WITH s AS (
+			UPDATE sessions
+			SET last_seen_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND last_seen_at < CURRENT_TIMESTAMP - INTERVAL '1 minute'
+			RETURNING user_id
+		 )
+		 INSERT INTO profiles (user_id, last_seen_at)
+		 SELECT user_id, CURRENT_TIMESTAMP FROM s
+		 ON CONFLICT (user_id) DO UPDATE SET last_seen_at = EXCLUDED.last_seen_at`,
+		sessionID,
+	)
+	return err
+}
+
+func ListSessions(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*Claims)
+		rows, err := db.Pool.Query(c.Request.Context(),
+			`SELECT id, device_name, user_agent, ip, created_at, last_seen_at
+			 FROM sessions
+			 WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+			 ORDER BY last_seen_at DESC`,
+			claims.UserID,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		defer rows.Close()
+
+		sessions := make([]Session, 0)
+		for rows.Next() {
+			var s Session
+			if err := rows.Scan(&s.ID, &s.DeviceName, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении сессий"})
+				return
+			}
+			s.Current = s.ID.String() == claims.SessionID
+			sessions = append(sessions, s)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при чтении сессий"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+	}
+}
+
+func RevokeSession(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный идентификатор сессии"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var exists bool
+		err = tx.QueryRow(ctx,
+			"SELECT EXISTS(SELECT 1 FROM sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL)",
+			sessionID, c.GetString("user_id"),
+		).Scan(&exists)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Сессия не найдена"})
+			return
+		}
+
+		if err := revokeSession(ctx, tx, sessionID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при завершении сессии"})
+			return
+		}
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		audit(c, db, "session.revoke", sessionID.String(), auditSuccess, nil)
+		c.JSON(http.StatusOK, gin.H{
+			"message":    "Сессия завершена",
+			"session_id": sessionID.String(),
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"authService/db"
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// LoginLimits задаёт защиту /auth/login от перебора. Попытки считаются
+// отдельно по логину и по IP; после порога ключ блокируется, и каждая
+// следующая неудача удваивает блокировку вплоть до MaxLockout. Удачная
+// попытка обнуляет счётчик логина и снимает себя со счётчика IP.
+type LoginLimits struct {
+	MaxFailuresPerLogin int
+	MaxFailuresPerIP    int
+	BaseLockout         time.Duration
+	MaxLockout          time.Duration
+	// Window — через сколько после последней неудачи счётчик обнуляется.
+	Window time.Duration
+}
+
+func DefaultLoginLimits() LoginLimits {
+	return LoginLimits{
+		MaxFailuresPerLogin: 5,
+		MaxFailuresPerIP:    50,
+		BaseLockout:         30 * time.Second,
+		MaxLockout:          time.Hour,
+		Window:              time.Hour,
+	}
+}
+
+func loginThrottleKey(login string) string {
+	return "login:" + strings.ToLower(login)
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Запросы сброса пароля считаются отдельно от входа: иначе письма
+// о сбросе выбирали бы лимит попыток входа и наоборот.
+func resetThrottleKey(email string) string {
+	return "reset:" + strings.ToLower(email)
+}
+
+func resetIPThrottleKey(ip string) string {
+	return "reset-ip:" + ip
+}
+
+// nextFailures — счётчик после ещё одной попытки: старые неудачи за
+// пределами окна забываются.
+const nextFailures = `CASE WHEN login_throttle.last_failure_at < $3 THEN 1
+	ELSE login_throttle.failures + 1 END`
+
+// lockoutFor — длительность блокировки после f попыток: BaseLockout,
+// удваиваемый за каждую попытку сверх порога, но не больше MaxLockout.
+func lockoutFor(f string) string {
+	return "least($5::float8 * power(2, least(" + f + " - $4, 30)), $6::float8) * interval '1 second'"
+}
+
+// acquireLoginAttempt засчитывает попытку по ключу ещё до проверки
+// пароля и в том же upsert решает, пропустить ли её. Параллельные
+// попытки сериализуются на строке ключа, поэтому за порог не проходит
+// ни одна лишняя: попытка, достигшая порога, сразу ставит блокировку
+// для остальных. Во время блокировки попытки не засчитываются.
+// Возвращает оставшееся время блокировки (old.locked_until из RETURNING
+// PostgreSQL 18 — блокировка до этой попытки) или ноль, если попытку
+// можно проверять.
+func acquireLoginAttempt(ctx context.Context, q querier, key string, threshold int, limits LoginLimits) (time.Duration, error) {
+	now := time.Now()
+	var lockedUntil *time.Time
+	err := q.QueryRow(ctx,
+		`INSERT INTO login_throttle (key, failures, last_failure_at, locked_until)
+		 VALUES ($1, 1, $2::timestamptz,
+		         CASE WHEN $4::int <= 1 THEN $2::timestamptz + `+lockoutFor("1")+` END)
+		 ON CONFLICT (key) DO UPDATE
+		 SET failures = CASE WHEN login_throttle.locked_until > $2 THEN login_throttle.failures
+		                     ELSE `+nextFailures+` END,
+		     last_failure_at = CASE WHEN login_throttle.locked_until > $2 THEN login_throttle.last_failure_at
+		                            ELSE $2 END,
+		     locked_until = CASE WHEN login_throttle.locked_until > $2 THEN login_throttle.locked_until
+		                         WHEN `+nextFailures+` >= $4 THEN $2 + `+lockoutFor(nextFailures)+`
+		                         ELSE NULL END
+		 RETURNING old.locked_until`,
+		key, now, now.Add(-limits.Window), threshold, limits.BaseLockout.Seconds(), limits.MaxLockout.Seconds(),
+	).Scan(&lockedUntil)
+	if err != nil || lockedUntil == nil || !lockedUntil.After(now) {
+		return 0, err
+	}
+	return lockedUntil.Sub(now), nil
+}
+
+// acquireLoginAttempts засчитывает попытку сразу по нескольким ключам
+// (ключ — порог). Если хоть один ключ заблокирован, попытка снимается
+// с остальных: проверки всё равно не будет.
+func acquireLoginAttempts(ctx context.Context, q querier, limits LoginLimits, keys map[string]int) (time.Duration, error) {
+	var acquired []string
+	var retryAfter time.Duration
+	for key, threshold := range keys {
+		wait, err := acquireLoginAttempt(ctx, q, key, threshold, limits)
+		if err != nil {
+			return 0, err
+		}
+		if wait > 0 {
+			retryAfter = max(retryAfter, wait)
+			continue
+		}
+		acquired = append(acquired, key)
+	}
+	if retryAfter > 0 {
+		for _, key := range acquired {
+			if err := releaseLoginAttempt(ctx, q, key, keys[key]); err != nil {
+				log.Printf("Failed to release login attempt: %v", err)
+			}
+		}
+	}
+	return retryAfter, nil
+}
+
+// releaseLoginAttempt снимает засчитанную попытку, которая оказалась
+// удачной или не была проверена. Нужен для ключей, которые удачный вход
+// не обнуляет, например для IP.
+func releaseLoginAttempt(ctx context.Context, q querier, key string, threshold int) error {
+	_, err := q.Exec(ctx,
+		`UPDATE login_throttle
+		 SET failures = greatest(failures - 1, 0),
+		     locked_until = CASE WHEN failures - 1 < $2 THEN NULL ELSE locked_until END
+		 WHERE key = $1`,
+		key, threshold,
+	)
+	return err
+}
+
+func respondThrottled(c *gin.Context, retryAfter time.Duration, message string) {
+	c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": message})
+}
+
+func resetLoginFailures(ctx context.Context, q querier, key string) error {
+	_, err := q.Exec(ctx, "DELETE FROM login_throttle WHERE key = $1", key)
+	return err
+}
+
+func UnlockAccount(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Login string `json:"login"`
+			IP    string `json:"ip"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Login == "" && req.IP == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Нужен login или ip"})
+			return
+		}
+
+		var keys []string
+		if req.Login != "" {
+			keys = append(keys, loginThrottleKey(req.Login))
+		}
+		if req.IP != "" {
+			keys = append(keys, ipThrottleKey(req.IP))
+		}
+
+		// Вместе с логином снимается и блокировка второго фактора его владельца.
+		cmdTag, err := db.Pool.Exec(c.Request.Context(),
+			`DELETE FROM login_throttle
+			 WHERE key = ANY($1)
+			    OR key = (SELECT '2fa:' || user_id FROM auth WHERE login = $2)`,
+			keys, req.Login,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		var target string
+		if req.Login != "" {
+			var userID uuid.UUID
+			if err := db.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM auth WHERE login = $1", req.Login).Scan(&userID); err == nil {
+				target = userID.String()
+			}
+		}
+		audit(c, db, "account.unlock", target, auditSuccess, gin.H{"ip": req.IP, "unlocked": cmdTag.RowsAffected()})
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "Блокировка снята",
+			"unlocked": cmdTag.RowsAffected(),
+		})
+	}
+}
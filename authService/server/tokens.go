@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"authService/keys"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// querier позволяет вызывать одни и те же хелперы как на пуле, так и внутри транзакции.
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func init() {
+	// iat с точностью до микросекунд: иначе токен, выданный в ту же
+	// секунду, что и logout-all, неотличим от отозванного.
+	jwt.TimePrecision = time.Microsecond
+}
+
+type TokenIssuer struct {
+	keys       *keys.Manager
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+func NewTokenIssuer(keys *keys.Manager, accessTTL, refreshTTL time.Duration) *TokenIssuer {
+	return &TokenIssuer{
+		keys:       keys,
+		AccessTTL:  accessTTL,
+		RefreshTTL: refreshTTL,
+	}
+}
+
+type Claims struct {
+	UserID      string   `json:"user_id"`
+	Username    string   `json:"username"`
+	Groups      []string `json:"groups"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	SessionID   string   `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (t *TokenIssuer) AccessToken(userID, sessionID uuid.UUID, username string, groups []uuid.UUID, access Access) (string, error) {
+	now := time.Now()
+	groupIDs := make([]string, 0, len(groups))
+	for _, g := range groups {
+		groupIDs = append(groupIDs, g.String())
+	}
+
+	key, err := t.keys.Signing()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.Method(), Claims{
+		UserID:      userID.String(),
+		Username:    username,
+		Groups:      groupIDs,
+		Roles:       access.Roles,
+		Permissions: access.Permissions,
+		SessionID:   sessionID.String(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(t.AccessTTL)),
+		},
+	})
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// Parse проверяет подпись и срок действия access-токена.
+// Отзыв проверяется отдельно через tokenRevoked.
+func (t *TokenIssuer) Parse(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := t.keys.Lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method != key.Method() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.Public(), nil
+	}, jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.ID == "" {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
+}
+
+// tokenRevoked сообщает, отозван ли токен по своему jti, вместе с сессией
+// либо массово через logout-all (auth.tokens_valid_after). Метку
+// tokens_valid_after ставит сам сервис по своим часам, как и iat, чтобы
+// расхождение с часами базы не отзывало только что выданные токены.
+func tokenRevoked(ctx context.Context, q querier, claims *Claims) (bool, error) {
+	var sessionID *string
+	if claims.SessionID != "" {
+		sessionID = &claims.SessionID
+	}
+
+	var revoked bool
+	var validAfter *time.Time
+	err := q.QueryRow(ctx,
+		`SELECT
+			EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = $1)
+			OR EXISTS(SELECT 1 FROM sessions WHERE id = $3::uuid AND revoked_at IS NOT NULL),
+			(SELECT tokens_valid_after FROM auth WHERE user_id = $2)`,
+		claims.ID, claims.UserID, sessionID,
+	).Scan(&revoked, &validAfter)
+	if err != nil {
+		return false, err
+	}
+	if revoked {
+		return true, nil
+	}
+	if validAfter != nil && claims.IssuedAt != nil && !claims.IssuedAt.After(*validAfter) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// NewRefreshToken выдаёт непрозрачный refresh-токен в семействе familyID.
+// Семейство совпадает с идентификатором сессии. В базе хранится только
+// SHA-256 от токена.
+func (t *TokenIssuer) NewRefreshToken(ctx context.Context, q querier, userID, familyID uuid.UUID) (uuid.UUID, string, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+
+	var id uuid.UUID
+	err = q.QueryRow(ctx,
+		`INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+		 VALUES ($1, $2, $3, $4)
+		 RETURNING id`,
+		userID, familyID, hashToken(raw), time.Now().Add(t.RefreshTTL),
+	).Scan(&id)
+	if err != nil {
+		return uuid.Nil, "", fmt.Errorf("failed to store refresh token: %w", err)
+	}
+	return id, raw, nil
+}
+
+func userGroups(ctx context.Context, q querier, userID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := q.Query(ctx,
+		`SELECT ug.group_id
+		 FROM user_group ug
+		 WHERE ug.user_id = $1`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []uuid.UUID
+	for rows.Next() {
+		var groupID uuid.UUID
+		if err := rows.Scan(&groupID); err != nil {
+			return nil, err
+		}
+		groups = append(groups, groupID)
+	}
+	return groups, rows.Err()
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,482 @@
+package server
+
+import (
+	"authService/db"
+	"authService/password"
+	"authService/totp"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	loginChallengeTTL         = 5 * time.Minute
+	loginChallengeMaxAttempts = 5
+	recoveryCodeCount         = 10
+	// recoveryCodeBytes — 80 бит, 16 символов base32.
+	recoveryCodeBytes = 10
+)
+
+func twoFactorEnabled(ctx context.Context, q querier, userID uuid.UUID) (bool, error) {
+	var enabled bool
+	err := q.QueryRow(ctx,
+		"SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)",
+		userID,
+	).Scan(&enabled)
+	return enabled, err
+}
+
+// newLoginChallenge выдаёт одноразовый токен второго шага входа.
+func newLoginChallenge(ctx context.Context, q querier, userID uuid.UUID, deviceName string) (string, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	var device *string
+	if deviceName != "" {
+		device = &deviceName
+	}
+	_, err = q.Exec(ctx,
+		`INSERT INTO login_challenges (user_id, token_hash, device_name, expires_at)
+		 VALUES ($1, $2, $3, $4)`,
+		userID, hashToken(raw), device, time.Now().Add(loginChallengeTTL),
+	)
+	if err != nil {
+		return "", err
+	}
+	_, _ = q.Exec(ctx, "DELETE FROM login_challenges WHERE expires_at < CURRENT_TIMESTAMP")
+	return raw, nil
+}
+
+// verifySecondFactor принимает либо TOTP-код, либо неиспользованный
+// код восстановления. Использованный код помечается в той же транзакции.
+func verifySecondFactor(ctx context.Context, q querier, recoveryKey []byte, userID uuid.UUID, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		cmdTag, err := q.Exec(ctx,
+			`UPDATE recovery_codes
+			 SET used_at = CURRENT_TIMESTAMP
+			 WHERE user_id = $1 AND used_at IS NULL
+			   AND ((keyed AND code_hash = $2) OR (NOT keyed AND code_hash = $3))`,
+			userID, hashRecoveryCode(recoveryKey, recoveryCode), legacyRecoveryCodeHash(recoveryCode),
+		)
+		if err != nil {
+			return false, err
+		}
+		return cmdTag.RowsAffected() == 1, nil
+	}
+
+	var secret string
+	var lastStep int64
+	err := q.QueryRow(ctx,
+		"SELECT secret, last_used_step FROM user_totp WHERE user_id = $1 FOR UPDATE",
+		userID,
+	).Scan(&secret, &lastStep)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok || step <= lastStep {
+		return false, nil
+	}
+	_, err = q.Exec(ctx, "UPDATE user_totp SET last_used_step = $1 WHERE user_id = $2", step, userID)
+	return err == nil, err
+}
+
+// twoFactorThrottleKey — счётчик неудачных кодов второго фактора.
+// Он ведётся по пользователю, а не по запросу 2FA, поэтому новый запрос
+// через /auth/login с известным паролем его не обнуляет.
+func twoFactorThrottleKey(userID uuid.UUID) string {
+	return "2fa:" + userID.String()
+}
+
+// acquireThrottled засчитывает попытку по ключам мимо транзакции запроса,
+// чтобы её откат не обнулял счётчики, и при блокировке отвечает 429.
+func acquireThrottled(c *gin.Context, db *db.Database, limits LoginLimits, keys map[string]int) bool {
+	retryAfter, err := acquireLoginAttempts(c.Request.Context(), db.Pool, limits, keys)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if retryAfter > 0 {
+		respondThrottled(c, retryAfter, "Слишком много попыток, попробуйте позже")
+		return false
+	}
+	return true
+}
+
+// generateRecoveryCodes выдаёт коды вида XXXX-XXXX-XXXX-XXXX из base32:
+// регистр не важен, поэтому при вводе ничего не теряется, и в каждом коде
+// 80 бит. В базе лежит HMAC с ключом сервера, так что без ключа утёкшую
+// таблицу не перебрать.
+func generateRecoveryCodes(ctx context.Context, q querier, recoveryKey []byte, userID uuid.UUID) ([]string, error) {
+	if _, err := q.Exec(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		b := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		raw := recoveryCodeEncoding.EncodeToString(b)
+		code := raw[:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:]
+		if _, err := q.Exec(ctx,
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID, hashRecoveryCode(recoveryKey, code),
+		); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// normalizeRecoveryCode убирает то, что пользователь мог ввести иначе:
+// регистр, пробелы и дефисы.
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, code)
+}
+
+func hashRecoveryCode(key []byte, code string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// legacyRecoveryCodeHash — хэш кодов, выданных до перехода на HMAC
+// (строки с keyed = false). Они действуют, пока пользователь не
+// подключит 2FA заново.
+func legacyRecoveryCodeHash(code string) string {
+	return hashToken(strings.ToLower(strings.TrimSpace(code)))
+}
+
+func Enroll2FA(db *db.Database, issuer string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		username := c.GetString("username")
+
+		var enabled bool
+		err := db.Pool.QueryRow(c.Request.Context(),
+			"SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)",
+			userID,
+		).Scan(&enabled)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if enabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Двухфакторная аутентификация уже включена"})
+			return
+		}
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании секрета"})
+			return
+		}
+
+		_, err = db.Pool.Exec(c.Request.Context(),
+			`INSERT INTO user_totp (user_id, secret)
+			 VALUES ($1, $2)
+			 ON CONFLICT (user_id) DO UPDATE
+			 SET secret = EXCLUDED.secret, last_used_step = 0, created_at = CURRENT_TIMESTAMP`,
+			userID, secret,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при сохранении секрета"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"secret":      secret,
+			"otpauth_uri": totp.URI(issuer, username, secret),
+		})
+	}
+}
+
+func Verify2FA(db *db.Database, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userID, err := uuid.Parse(c.GetString("user_id"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var enabledAt *time.Time
+		err = tx.QueryRow(ctx, "SELECT enabled_at FROM user_totp WHERE user_id = $1", userID).Scan(&enabledAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Сначала начните подключение 2FA"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if enabledAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Двухфакторная аутентификация уже включена"})
+			return
+		}
+
+		ok, err := verifySecondFactor(ctx, tx, config.RecoveryCodeKey, userID, req.Code, "")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверный код"})
+			return
+		}
+
+		if _, err := tx.Exec(ctx, "UPDATE user_totp SET enabled_at = CURRENT_TIMESTAMP WHERE user_id = $1", userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		codes, err := generateRecoveryCodes(ctx, tx, config.RecoveryCodeKey, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при создании кодов восстановления"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		audit(c, db, "2fa.enable", userID.String(), auditSuccess, nil)
+		c.JSON(http.StatusOK, gin.H{
+			"message":        "Двухфакторная аутентификация включена",
+			"recovery_codes": codes,
+		})
+	}
+}
+
+func Disable2FA(db *db.Database, hasher *password.Hasher, config Config) gin.HandlerFunc {
+	limits := config.LoginLimits
+	return func(c *gin.Context) {
+		var req struct {
+			Password     string `json:"password" binding:"required"`
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recovery_code"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userID, err := uuid.Parse(c.GetString("user_id"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var login, storedPassword string
+		if err := tx.QueryRow(ctx, "SELECT login, password FROM auth WHERE user_id = $1", userID).Scan(&login, &storedPassword); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		loginKey := loginThrottleKey(login)
+		if !acquireThrottled(c, db, limits, map[string]int{loginKey: limits.MaxFailuresPerLogin}) {
+			return
+		}
+		if ok, _, _ := hasher.Verify(req.Password, storedPassword); !ok {
+			audit(c, db, "2fa.disable", userID.String(), auditFailure, gin.H{"reason": "bad_password"})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверный пароль"})
+			return
+		}
+		if err := resetLoginFailures(ctx, db.Pool, loginKey); err != nil {
+			log.Printf("Failed to reset login failures for user %s: %v", userID, err)
+		}
+
+		twoFactorKey := twoFactorThrottleKey(userID)
+		if !acquireThrottled(c, db, limits, map[string]int{twoFactorKey: limits.MaxFailuresPerLogin}) {
+			return
+		}
+
+		ok, err := verifySecondFactor(ctx, tx, config.RecoveryCodeKey, userID, req.Code, req.RecoveryCode)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Двухфакторная аутентификация не включена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !ok {
+			audit(c, db, "2fa.disable", userID.String(), auditFailure, gin.H{"reason": "bad_code"})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверный код"})
+			return
+		}
+
+		if _, err := tx.Exec(ctx, "DELETE FROM user_totp WHERE user_id = $1", userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if _, err := tx.Exec(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		if err := resetLoginFailures(ctx, db.Pool, twoFactorKey); err != nil {
+			log.Printf("Failed to reset 2FA failures for user %s: %v", userID, err)
+		}
+		audit(c, db, "2fa.disable", userID.String(), auditSuccess, nil)
+		c.JSON(http.StatusOK, gin.H{"message": "Двухфакторная аутентификация отключена"})
+	}
+}
+
+func Login2FA(db *db.Database, tokens *TokenIssuer, config Config) gin.HandlerFunc {
+	limits := config.LoginLimits
+	return func(c *gin.Context) {
+		var req struct {
+			ChallengeToken string `json:"challenge_token" binding:"required"`
+			Code           string `json:"code"`
+			RecoveryCode   string `json:"recovery_code"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Code == "" && req.RecoveryCode == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Нужен code или recovery_code"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction error"})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var challengeID, userID uuid.UUID
+		var deviceName *string
+		var attempts int
+		err = tx.QueryRow(ctx,
+			`SELECT id, user_id, device_name, attempts
+			 FROM login_challenges
+			 WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+			 FOR UPDATE`,
+			hashToken(req.ChallengeToken),
+		).Scan(&challengeID, &userID, &deviceName, &attempts)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Запрос 2FA недействителен или истёк"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if attempts >= loginChallengeMaxAttempts {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Запрос 2FA недействителен или истёк"})
+			return
+		}
+		twoFactorKey := twoFactorThrottleKey(userID)
+		ipKey := ipThrottleKey(c.ClientIP())
+		if !acquireThrottled(c, db, limits, map[string]int{
+			twoFactorKey: limits.MaxFailuresPerLogin,
+			ipKey:        limits.MaxFailuresPerIP,
+		}) {
+			return
+		}
+
+		ok, err := verifySecondFactor(ctx, tx, config.RecoveryCodeKey, userID, req.Code, req.RecoveryCode)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !ok {
+			_, err = tx.Exec(ctx, "UPDATE login_challenges SET attempts = attempts + 1 WHERE id = $1", challengeID)
+			if err == nil {
+				err = tx.Commit(ctx)
+			}
+			if err != nil {
+				log.Printf("Failed to record 2FA attempt for user %s: %v", userID, err)
+			}
+			auditAs(c, db, userID.String(), "auth.login_2fa", userID.String(), auditFailure,
+				gin.H{"reason": "bad_code", "recovery_code": req.RecoveryCode != ""})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Неверный код"})
+			return
+		}
+
+		if _, err := tx.Exec(ctx, "UPDATE login_challenges SET used_at = CURRENT_TIMESTAMP WHERE id = $1", challengeID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		var username string
+		if err := tx.QueryRow(ctx, "SELECT username FROM users WHERE id = $1", userID).Scan(&username); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Пользователь не найден"})
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Коммит не осуществлён"})
+			return
+		}
+
+		if err := resetLoginFailures(ctx, db.Pool, twoFactorKey); err != nil {
+			log.Printf("Failed to reset 2FA failures for user %s: %v", userID, err)
+		}
+		if err := releaseLoginAttempt(ctx, db.Pool, ipKey, limits.MaxFailuresPerIP); err != nil {
+			log.Printf("Failed to release login attempt: %v", err)
+		}
+		device := ""
+		if deviceName != nil {
+			device = *deviceName
+		}
+		completeLogin(c, db, tokens, userID, username, device)
+	}
+}
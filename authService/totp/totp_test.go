@@ -0,0 +1,113 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret — ключ из тестовых векторов RFC 6238 (SHA1).
+var rfcSecret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestValidateRFCVectors(t *testing.T) {
+	// Коды из приложения B RFC 6238, последние шесть цифр.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		now := time.Unix(tt.unix, 0)
+		step, ok := Validate(rfcSecret, tt.code, now)
+		if !ok {
+			t.Errorf("Validate(%s) at %d rejected", tt.code, tt.unix)
+			continue
+		}
+		if want := tt.unix / int64(Period.Seconds()); step != want {
+			t.Errorf("Validate(%s) at %d step = %d, want %d", tt.code, tt.unix, step, want)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	key, _ := encoding.DecodeString(rfcSecret)
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / int64(Period.Seconds())
+
+	for offset := int64(-Skew - 1); offset <= Skew+1; offset++ {
+		got, ok := Validate(rfcSecret, generate(key, step+offset), now)
+		wantOK := offset >= -Skew && offset <= Skew
+		if ok != wantOK {
+			t.Errorf("offset %d: ok = %v, want %v", offset, ok, wantOK)
+		}
+		if ok && got != step+offset {
+			t.Errorf("offset %d: step = %d, want %d", offset, got, step+offset)
+		}
+	}
+}
+
+func TestValidateRejectsMalformed(t *testing.T) {
+	now := time.Unix(59, 0)
+	tests := map[string]struct{ secret, code string }{
+		"short code":   {rfcSecret, "28708"},
+		"long code":    {rfcSecret, "94287082"},
+		"wrong code":   {rfcSecret, "000000"},
+		"bad secret":   {"not base32!", "287082"},
+		"empty secret": {"", "287082"},
+	}
+	for name, tt := range tests {
+		if _, ok := Validate(tt.secret, tt.code, now); ok {
+			t.Errorf("%s: Validate(%q, %q) accepted", name, tt.secret, tt.code)
+		}
+	}
+}
+
+func TestValidateLowercaseSecret(t *testing.T) {
+	if _, ok := Validate(strings.ToLower(rfcSecret), "287082", time.Unix(59, 0)); !ok {
+		t.Error("lowercase secret rejected")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret: %v", err)
+	}
+	b, _ := GenerateSecret()
+	if a == b {
+		t.Error("two secrets are equal")
+	}
+	key, err := encoding.DecodeString(a)
+	if err != nil || len(key) != secretLen {
+		t.Errorf("secret %q decodes to %d bytes (%v), want %d", a, len(key), err, secretLen)
+	}
+}
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI("Chat App", "alice@example.com", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Chat App:alice@example.com" {
+		t.Errorf("unexpected URI %s", u)
+	}
+	q := u.Query()
+	for key, want := range map[string]string{
+		"secret":    "JBSWY3DPEHPK3PXP",
+		"issuer":    "Chat App",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	} {
+		if got := q.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
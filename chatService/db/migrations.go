@@ -39,6 +39,114 @@ var migrations = []Migration{
 			CREATE INDEX IF NOT EXISTS idx_user_chat_chat ON user_chat(chat_id);
 		`,
 	},
+	{
+		Name: "processed_events",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS processed_events (
+				id UUID PRIMARY KEY,
+				type VARCHAR(100) NOT NULL,
+				processed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE INDEX IF NOT EXISTS idx_messages_user_id ON messages(user_id);
+		`,
+	},
+	{
+		Name: "outbox",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS outbox (
+				id UUID PRIMARY KEY DEFAULT uuidv4(),
+				seq BIGSERIAL NOT NULL,
+				type VARCHAR(100) NOT NULL,
+				payload JSONB NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				attempts INT NOT NULL DEFAULT 0,
+				next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				last_error TEXT,
+				delivered_at TIMESTAMP WITH TIME ZONE
+			);
+			CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(seq) WHERE delivered_at IS NULL;
+		`,
+	},
+	{
+		Name: "consumer_offsets",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS consumer_offsets (
+				consumer VARCHAR(100) PRIMARY KEY,
+				position BIGINT NOT NULL DEFAULT 0,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);
+			ALTER TABLE processed_events ADD COLUMN IF NOT EXISTS consumer VARCHAR(100) NOT NULL DEFAULT 'chat';
+			ALTER TABLE processed_events ALTER COLUMN consumer DROP DEFAULT;
+			ALTER TABLE processed_events DROP CONSTRAINT IF EXISTS processed_events_pkey;
+			ALTER TABLE processed_events ADD PRIMARY KEY (consumer, id);
+		`,
+	},
+	{
+		Name: "chat_roles",
+		SQL: `
+			ALTER TABLE user_chat ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'member'
+				CHECK (role IN ('owner', 'admin', 'member'));
+			ALTER TABLE user_chat ADD COLUMN IF NOT EXISTS joined_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP;
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_user_chat_owner ON user_chat(chat_id) WHERE role = 'owner';
+
+			-- Создателя раньше не запоминали: владельцем становится автор
+			-- самого раннего сообщения среди участников, иначе любой участник.
+			UPDATE user_chat uc SET role = 'owner'
+			FROM (
+				SELECT DISTINCT ON (uc.chat_id) uc.chat_id, uc.user_id
+				FROM user_chat uc
+				LEFT JOIN LATERAL (
+					SELECT min(m.created_at) AS first_message
+					FROM messages m
+					WHERE m.chat_id = uc.chat_id AND m.user_id = uc.user_id
+				) m ON TRUE
+				ORDER BY uc.chat_id, m.first_message NULLS LAST, uc.user_id
+			) first
+			WHERE uc.chat_id = first.chat_id AND uc.user_id = first.user_id;
+		`,
+	},
+	{
+		Name: "chat_events",
+		SQL: `
+			ALTER TABLE chats ADD COLUMN IF NOT EXISTS event_seq BIGINT NOT NULL DEFAULT 0;
+			-- Без внешнего ключа: событие удаления чата переживает сам чат.
+			CREATE TABLE IF NOT EXISTS chat_events (
+				chat_id UUID NOT NULL,
+				seq BIGINT NOT NULL,
+				type VARCHAR(50) NOT NULL,
+				data JSONB NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (chat_id, seq)
+			);
+			CREATE INDEX IF NOT EXISTS idx_chat_events_created ON chat_events(created_at);
+		`,
+	},
+	{
+		Name: "consumer_offsets_stream",
+		SQL: `
+			-- Позиция имеет смысл только в своём потоке шины. Старые строки
+			-- остаются под пустым именем и больше не читаются; повторы
+			-- отсеивает processed_events.
+			ALTER TABLE consumer_offsets ADD COLUMN IF NOT EXISTS stream VARCHAR(255) NOT NULL DEFAULT '';
+			ALTER TABLE consumer_offsets ALTER COLUMN stream DROP DEFAULT;
+			ALTER TABLE consumer_offsets DROP CONSTRAINT IF EXISTS consumer_offsets_pkey;
+			ALTER TABLE consumer_offsets ADD PRIMARY KEY (consumer, stream);
+		`,
+	},
+	{
+		Name: "stream_snapshots",
+		SQL: `
+			-- Позиции SSE-потока во всех чатах пользователя; id события
+			-- ссылается на снимок и несёт только отличия от него.
+			CREATE TABLE IF NOT EXISTS stream_snapshots (
+				id UUID PRIMARY KEY DEFAULT uuidv4(),
+				user_id UUID NOT NULL,
+				positions BYTEA NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE INDEX IF NOT EXISTS idx_stream_snapshots_created ON stream_snapshots(created_at);
+		`,
+	},
 }
 
 func (db *Database) RunMigrations(ctx context.Context) error {
@@ -2,15 +2,19 @@ package main
 
 import (
 	"chatService/db"
+	"chatService/outbox"
+	"chatService/pubsub"
 	"chatService/server"
 	"context"
+	"eventBus/bus"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"time"
 )
 
 func main() {
-	jwtSecret := "super-secret-pass"
 	connStr := os.Getenv("POSTGRES_URL")
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -23,10 +27,112 @@ func main() {
 		log.Fatalf("Failed to run migrations: %v", err)
 	}
 	log.Println("Database migrations completed successfully")
-	srv := server.New(database, jwtSecret)
+	authURL := os.Getenv("AUTH_SERVICE_URL")
+	if authURL == "" {
+		log.Fatal("AUTH_SERVICE_URL is required")
+	}
+	jwksURL := os.Getenv("JWKS_URL")
+	if jwksURL == "" {
+		jwksURL = authURL + "/.well-known/jwks.json"
+	}
+	jwks := server.NewJWKS(jwksURL, envDuration("JWKS_CACHE_TTL", 5*time.Minute))
+	// Токен сервиса нужен для проверки отзыва, имён в ответах и API-ключей.
+	token := os.Getenv("AUTH_SERVICE_TOKEN")
+	if token == "" {
+		log.Fatal("AUTH_SERVICE_TOKEN is required")
+	}
+	revoked := server.NewRevocationChecker(authURL, token, envDuration("REVOCATION_CACHE_TTL", 30*time.Second))
+	users := server.NewUserDirectory(authURL, token, envDuration("USER_CACHE_TTL", time.Minute))
+	keys := server.NewAPIKeyVerifier(authURL, token, envDuration("API_KEY_CACHE_TTL", 30*time.Second))
+	config := server.Config{
+		DeletionPolicy:     envString("USER_DELETION_POLICY", server.DeletionAnonymize),
+		PingInterval:       envDuration("WS_PING_INTERVAL", 30*time.Second),
+		SendBuffer:         envInt("WS_SEND_BUFFER", 64),
+		RevalidateInterval: envDuration("STREAM_REVALIDATE_INTERVAL", 30*time.Second),
+	}
+	if config.DeletionPolicy != server.DeletionAnonymize && config.DeletionPolicy != server.DeletionDelete {
+		log.Fatalf("Unknown USER_DELETION_POLICY %q", config.DeletionPolicy)
+	}
+
+	ps, err := newPubSub(database)
+	if err != nil {
+		log.Fatalf("Failed to configure pubsub: %v", err)
+	}
+	defer ps.Close()
+	hub := server.NewHub(database, ps)
+	if err := hub.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to subscribe to chat events: %v", err)
+	}
+	go hub.RunPruning(context.Background(), envDuration("CHAT_EVENT_RETENTION", 72*time.Hour), time.Hour)
+
+	eventBus, err := newBus(ctx)
+	if err != nil {
+		log.Fatalf("Failed to connect to event bus: %v", err)
+	}
+	defer eventBus.Close()
+	// Потребитель подписывается раньше relay: шина в памяти держит события,
+	// пока их не прочтут все подписчики.
+	consumer := outbox.NewConsumer(database, "chat")
+	server.RegisterEventHandlers(consumer, hub, config)
+	if err := consumer.Start(context.Background(), eventBus); err != nil {
+		log.Fatalf("Failed to start event consumer: %v", err)
+	}
+	relay := outbox.NewRelay(database, eventBus, 100)
+	go relay.Run(context.Background(), envDuration("OUTBOX_POLL_INTERVAL", time.Second))
+
+	srv := server.New(database, jwks, revoked, users, keys, hub, config)
 	port := os.Getenv("SERVER_PORT")
-	log.Printf("Auth Service starting on :%s", port)
+	log.Printf("Chat Service starting on :%s", port)
 	if err := srv.Start(":" + port); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// newBus выбирает шину событий: NATS для обмена между сервисами или
+// шину в памяти, если сервис запущен сам по себе.
+func newBus(ctx context.Context) (bus.Bus, error) {
+	switch backend := envString("EVENT_BUS", "inprocess"); backend {
+	case "nats":
+		return bus.NewNATS(ctx, envString("NATS_URL", "nats://localhost:4222"), envString("NATS_STREAM", "EVENTS"))
+	case "inprocess":
+		log.Println("Using in-process event bus, events from other services will not arrive")
+		return bus.NewInProcess(), nil
+	default:
+		return nil, fmt.Errorf("unknown event bus %q", backend)
+	}
+}
+
+// newPubSub выбирает, как события чатов расходятся между экземплярами:
+// через LISTEN/NOTIFY общей базы или только внутри процесса.
+func newPubSub(database *db.Database) (pubsub.PubSub, error) {
+	switch backend := envString("REALTIME_PUBSUB", "postgres"); backend {
+	case "postgres":
+		return pubsub.NewPostgres(database), nil
+	case "memory":
+		log.Println("Using in-memory pubsub, chat events will not reach other replicas")
+		return pubsub.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown pubsub backend %q", backend)
+	}
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,127 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"chatService/db"
+	"eventBus/bus"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// TxHandler применяет событие внутри транзакции потребителя.
+type TxHandler func(ctx context.Context, tx pgx.Tx, event bus.Event) error
+
+type afterCommitKey struct{}
+
+// AfterCommit откладывает fn до коммита транзакции потребителя, чтобы
+// обработчик сообщал только о сохранённых изменениях. Вне потребителя
+// fn вызывается сразу.
+func AfterCommit(ctx context.Context, fn func()) {
+	if hooks, ok := ctx.Value(afterCommitKey{}).(*[]func()); ok {
+		*hooks = append(*hooks, fn)
+		return
+	}
+	fn()
+}
+
+// Consumer читает шину с сохранённой позиции. Позиция, отметка об
+// обработанном событии и сами изменения фиксируются одной транзакцией,
+// поэтому повторная доставка ничего не применяет дважды. Позиции хранятся
+// отдельно для каждого потока шины.
+type Consumer struct {
+	db       *db.Database
+	name     string
+	stream   string
+	handlers map[string]TxHandler
+}
+
+func NewConsumer(database *db.Database, name string) *Consumer {
+	return &Consumer{db: database, name: name, handlers: make(map[string]TxHandler)}
+}
+
+// Handle регистрирует обработчик типа событий. Остальные события
+// только сдвигают позицию.
+func (c *Consumer) Handle(eventType string, handler TxHandler) {
+	c.handlers[eventType] = handler
+}
+
+func (c *Consumer) Start(ctx context.Context, b bus.Bus) error {
+	c.stream = b.Stream()
+	// Потоки шины в памяти умирают вместе с процессом, их позиции больше не нужны.
+	_, err := c.db.Pool.Exec(ctx,
+		"DELETE FROM consumer_offsets WHERE consumer = $1 AND stream LIKE 'inprocess:%' AND stream <> $2",
+		c.name, c.stream,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to drop stale offsets of %s: %w", c.name, err)
+	}
+
+	var position int64
+	err = c.db.Pool.QueryRow(ctx,
+		"SELECT position FROM consumer_offsets WHERE consumer = $1 AND stream = $2",
+		c.name, c.stream,
+	).Scan(&position)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("failed to load offset of %s: %w", c.name, err)
+	}
+	return b.Subscribe(ctx, c.name, uint64(position)+1, c.apply)
+}
+
+func (c *Consumer) apply(ctx context.Context, d bus.Delivery) error {
+	tx, err := c.db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var position int64
+	err = tx.QueryRow(ctx,
+		`INSERT INTO consumer_offsets (consumer, stream, position) VALUES ($1, $2, 0)
+		 ON CONFLICT (consumer, stream) DO UPDATE SET consumer = EXCLUDED.consumer
+		 RETURNING position`,
+		c.name, c.stream,
+	).Scan(&position)
+	if err != nil {
+		return err
+	}
+	if d.Position <= uint64(position) {
+		return nil
+	}
+
+	var hooks []func()
+
+	if handler, ok := c.handlers[d.Type]; ok {
+		// Шина в памяти не отсеивает повторную публикацию после сбоя relay,
+		// поэтому обработанные события запоминаются ещё и по id.
+		cmdTag, err := tx.Exec(ctx,
+			"INSERT INTO processed_events (consumer, id, type) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+			c.name, d.ID, d.Type,
+		)
+		if err != nil {
+			return err
+		}
+		if cmdTag.RowsAffected() == 1 {
+			if err := handler(context.WithValue(ctx, afterCommitKey{}, &hooks), tx, d.Event); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE consumer_offsets SET position = $3, updated_at = CURRENT_TIMESTAMP WHERE consumer = $1 AND stream = $2",
+		c.name, c.stream, int64(d.Position),
+	)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	for _, fn := range hooks {
+		fn()
+	}
+	return nil
+}
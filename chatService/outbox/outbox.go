@@ -0,0 +1,184 @@
+// Package outbox реализует транзакционный outbox: событие пишется в ту же
+// транзакцию, что и изменение состояния, а Relay затем публикует его в
+// шину с повторами, пока шина не примет.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"chatService/db"
+	"eventBus/bus"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	TypeChatCreated = "chat.created"
+	TypeChatDeleted = "chat.deleted"
+	TypeMessageSent = "message.sent"
+
+	// Source попадает в каждое событие, чтобы получатель отличал отправителей.
+	Source = "chat"
+
+	maxBackoff = 10 * time.Minute
+	// relayLockID — ключ advisory-блокировки: публикует одна реплика,
+	// чтобы события уходили в шину в порядке seq.
+	relayLockID = 0x6f757462
+)
+
+type ChatCreated struct {
+	ChatID    uuid.UUID `json:"chat_id"`
+	CreatedBy uuid.UUID `json:"created_by"`
+}
+
+type ChatDeleted struct {
+	ChatID uuid.UUID `json:"chat_id"`
+}
+
+type MessageSent struct {
+	MessageID int64     `json:"message_id"`
+	ChatID    uuid.UUID `json:"chat_id"`
+	UserID    uuid.UUID `json:"user_id"`
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// Enqueue кладёт событие в outbox. q должен быть транзакцией, в которой
+// меняется состояние, иначе теряется смысл outbox.
+func Enqueue(ctx context.Context, q execer, eventType string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s payload: %w", eventType, err)
+	}
+	_, err = q.Exec(ctx,
+		"INSERT INTO outbox (type, payload) VALUES ($1, $2)",
+		eventType, data,
+	)
+	return err
+}
+
+// Relay публикует недоставленные события в шину. При ошибке пачка
+// обрывается, чтобы более поздние события не обогнали застрявшее.
+type Relay struct {
+	db    *db.Database
+	bus   bus.Bus
+	batch int
+}
+
+func NewRelay(database *db.Database, b bus.Bus, batch int) *Relay {
+	return &Relay{db: database, bus: b, batch: batch}
+}
+
+func (r *Relay) Run(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.Flush(ctx); err != nil {
+				log.Printf("Outbox relay failed: %v", err)
+			}
+		}
+	}
+}
+
+// Flush публикует одну пачку событий и возвращает число опубликованных.
+func (r *Relay) Flush(ctx context.Context) (int, error) {
+	tx, err := r.db.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1)", relayLockID).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	rows, err := tx.Query(ctx,
+		`SELECT id, type, created_at, payload, attempts, next_attempt_at
+		 FROM outbox
+		 WHERE delivered_at IS NULL
+		 ORDER BY seq
+		 LIMIT $1`,
+		r.batch,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	type pending struct {
+		event       bus.Event
+		attempts    int
+		nextAttempt time.Time
+	}
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		p.event.Source = Source
+		if err := rows.Scan(&p.event.ID, &p.event.Type, &p.event.OccurredAt, &p.event.Payload, &p.attempts, &p.nextAttempt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for _, p := range batch {
+		if time.Now().Before(p.nextAttempt) {
+			break
+		}
+		if err := r.bus.Publish(ctx, p.event); err != nil {
+			log.Printf("Failed to publish event %s (%s), attempt %d: %v", p.event.ID, p.event.Type, p.attempts+1, err)
+			if err := markFailed(ctx, tx, p.event.ID, p.attempts+1, err); err != nil {
+				return published, err
+			}
+			break
+		}
+		if _, err := tx.Exec(ctx, "UPDATE outbox SET delivered_at = CURRENT_TIMESTAMP WHERE id = $1", p.event.ID); err != nil {
+			return published, err
+		}
+		published++
+	}
+
+	return published, tx.Commit(ctx)
+}
+
+func markFailed(ctx context.Context, tx pgx.Tx, id uuid.UUID, attempts int, cause error) error {
+	_, err := tx.Exec(ctx,
+		`UPDATE outbox
+		 SET attempts = $2, last_error = $3, next_attempt_at = $4
+		 WHERE id = $1`,
+		id, attempts, cause.Error(), time.Now().Add(backoff(attempts)),
+	)
+	return err
+}
+
+// backoff удваивает паузу между попытками: 1с, 2с, 4с… но не больше maxBackoff.
+func backoff(attempts int) time.Duration {
+	if attempts > 20 {
+		return maxBackoff
+	}
+	d := time.Second << (attempts - 1)
+	if d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
@@ -0,0 +1,92 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryBuffer — сколько уведомлений ждут медленного подписчика,
+// прежде чем Publish начнёт его ждать.
+const memoryBuffer = 1024
+
+// Memory доставляет уведомления внутри одного процесса. Подходит для
+// одного экземпляра сервиса и для тестов.
+type Memory struct {
+	mu   sync.Mutex
+	subs map[string][]chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		subs: make(map[string][]chan []byte),
+		done: make(chan struct{}),
+	}
+}
+
+func (m *Memory) Publish(ctx context.Context, channel string, payload []byte) error {
+	select {
+	case <-m.done:
+		return ErrClosed
+	default:
+	}
+	m.mu.Lock()
+	subs := append([]chan []byte(nil), m.subs[channel]...)
+	m.mu.Unlock()
+
+	for _, ch := range subs {
+		select {
+		case ch <- payload:
+		case <-m.done:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(ctx context.Context, channel string, handler Handler) error {
+	select {
+	case <-m.done:
+		return ErrClosed
+	default:
+	}
+	ch := make(chan []byte, memoryBuffer)
+	m.mu.Lock()
+	m.subs[channel] = append(m.subs[channel], ch)
+	m.mu.Unlock()
+
+	go func() {
+		defer m.unsubscribe(channel, ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.done:
+				return
+			case payload := <-ch:
+				handler(ctx, payload)
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *Memory) unsubscribe(channel string, ch chan []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subs := m.subs[channel]
+	for i, c := range subs {
+		if c == ch {
+			m.subs[channel] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *Memory) Close() error {
+	m.once.Do(func() { close(m.done) })
+	return nil
+}
@@ -0,0 +1,101 @@
+package pubsub
+
+import (
+	"chatService/db"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// maxNotifyPayload — предел NOTIFY в Postgres по умолчанию (8000 байт)
+// с запасом.
+const maxNotifyPayload = 7900
+
+const maxReconnectDelay = 30 * time.Second
+
+// Postgres рассылает уведомления через LISTEN/NOTIFY той же базы,
+// с которой работают все экземпляры сервиса. Каждая подписка держит
+// отдельное соединение из пула.
+type Postgres struct {
+	db *db.Database
+}
+
+func NewPostgres(db *db.Database) *Postgres {
+	return &Postgres{db: db}
+}
+
+func (p *Postgres) Publish(ctx context.Context, channel string, payload []byte) error {
+	if len(payload) > maxNotifyPayload {
+		return fmt.Errorf("notification on %s is %d bytes, limit is %d", channel, len(payload), maxNotifyPayload)
+	}
+	_, err := p.db.Pool.Exec(ctx, "SELECT pg_notify($1, $2)", channel, string(payload))
+	return err
+}
+
+func (p *Postgres) Subscribe(ctx context.Context, channel string, handler Handler) error {
+	conn, err := p.listen(ctx, channel)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		delay := 100 * time.Millisecond
+		for {
+			err := p.receive(ctx, conn, handler)
+			conn.Close(context.Background())
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Lost LISTEN connection for %s, reconnecting: %v", channel, err)
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+				delay = min(delay*2, maxReconnectDelay)
+				if conn, err = p.listen(ctx, channel); err == nil {
+					delay = 100 * time.Millisecond
+					break
+				}
+				log.Printf("Failed to re-listen on %s: %v", channel, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// listen забирает соединение из пула насовсем: после LISTEN его нельзя
+// возвращать, иначе уведомления достанутся случайному запросу.
+func (p *Postgres) listen(ctx context.Context, channel string) (*pgx.Conn, error) {
+	pooled, err := p.db.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire connection for LISTEN: %w", err)
+	}
+	conn := pooled.Hijack()
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		conn.Close(context.Background())
+		return nil, fmt.Errorf("failed to LISTEN on %s: %w", channel, err)
+	}
+	return conn, nil
+}
+
+func (p *Postgres) receive(ctx context.Context, conn *pgx.Conn, handler Handler) error {
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		handler(ctx, []byte(n.Payload))
+	}
+}
+
+// Close ничего не делает: подписки закрываются вместе со своими ctx,
+// а пул принадлежит db.Database.
+func (p *Postgres) Close() error {
+	return nil
+}
@@ -0,0 +1,24 @@
+// Package pubsub рассылает короткие уведомления между экземплярами
+// chatService. Доставка «не более одного раза»: уведомления, пришедшие,
+// пока подписчик переподключался, теряются, поэтому в них кладутся
+// ссылки на строки в базе, а не сами данные.
+package pubsub
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrClosed = errors.New("pubsub closed")
+
+// Handler вызывается для каждого уведомления по порядку публикации
+// в пределах одного экземпляра.
+type Handler func(ctx context.Context, payload []byte)
+
+type PubSub interface {
+	Publish(ctx context.Context, channel string, payload []byte) error
+	// Subscribe возвращается, когда подписка установлена, и вызывает
+	// handler, пока не отменён ctx.
+	Subscribe(ctx context.Context, channel string, handler Handler) error
+	Close() error
+}
@@ -1,7 +1,8 @@
 package server
 
 import (
-	"fmt"
+	"context"
+	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -12,26 +13,53 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+type Config struct {
+	// DeletionPolicy — что делать с сообщениями удалённого пользователя:
+	// DeletionAnonymize или DeletionDelete.
+	DeletionPolicy string
+	// PingInterval — как часто /chat/ws проверяет, что клиент жив.
+	PingInterval time.Duration
+	// SendBuffer — сколько событий ждут отправки одному подключению,
+	// прежде чем оно будет закрыто как медленное.
+	SendBuffer int
+	// RevalidateInterval — как часто /chat/ws и /chat/events проверяют,
+	// что токен или ключ подключения не отозван.
+	RevalidateInterval time.Duration
+}
+
 type Server struct {
-	db        *db.Database
-	router    *gin.Engine
-	jwtSecret string
+	db      *db.Database
+	router  *gin.Engine
+	jwks    *JWKS
+	revoked *RevocationChecker
+	users   *UserDirectory
+	keys    *APIKeyVerifier
+	hub     *Hub
+	config  Config
 }
 
-func New(database *db.Database, jwtSecret string) *Server {
-	router := gin.Default()
+func New(database *db.Database, jwks *JWKS, revoked *RevocationChecker, users *UserDirectory, keys *APIKeyVerifier, hub *Hub, config Config) *Server {
+	router := gin.New()
+	router.Use(gin.LoggerWithFormatter(logFormatter), gin.Recovery())
 
 	s := &Server{
-		db:        database,
-		router:    router,
-		jwtSecret: jwtSecret,
+		db:      database,
+		router:  router,
+		jwks:    jwks,
+		revoked: revoked,
+		users:   users,
+		keys:    keys,
+		hub:     hub,
+		config:  config,
 	}
 
 	s.setupRoutes()
 	return s
 }
 
-func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
+// AuthMiddleware принимает JWT пользователя или API-ключ сервисного аккаунта
+// и в обоих случаях кладёт в контекст user_id, username и groups.
+func AuthMiddleware(jwks *JWKS, revoked *RevocationChecker, keys *APIKeyVerifier) gin.HandlerFunc {
 	type Claims struct {
 		UserID   string   `json:"user_id"`
 		Username string   `json:"username"`
@@ -40,6 +68,11 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 	}
 
 	return func(c *gin.Context) {
+		if key := apiKeyFromRequest(c); key != "" {
+			authenticateAPIKey(c, keys, key)
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is required"})
@@ -47,23 +80,39 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 		}
 
 		parts := strings.Split(authHeader, " ")
+		tokenString := parts[len(parts)-1]
 		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(parts[len(parts)-1], claims, func(token *jwt.Token) (interface{}, error) {
-			if token.Method != jwt.SigningMethodHS256 {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(jwtSecret), nil
-		})
+		token, err := jwt.ParseWithClaims(tokenString, claims, jwks.Keyfunc(c.Request.Context()), jwt.WithExpirationRequired())
 
-		if err != nil || !token.Valid {
+		if err != nil || !token.Valid || claims.ID == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			return
 		}
 
+		if revoked != nil {
+			isRevoked, err := revoked.Revoked(c.Request.Context(), claims.ID, tokenString, claims.ExpiresAt.Time)
+			if err != nil {
+				log.Printf("Failed to check token revocation: %v", err)
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Auth service unavailable"})
+				return
+			}
+			if isRevoked {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token revoked"})
+				return
+			}
+		}
+
 		c.Set("user_id", claims.UserID)
 		c.Set("username", claims.Username)
 		c.Set("groups", claims.Groups)
 		c.Set("claims", claims)
+		setSession(c, claims.ExpiresAt.Time, func(ctx context.Context) (bool, error) {
+			if revoked == nil {
+				return true, nil
+			}
+			isRevoked, err := revoked.Revoked(ctx, claims.ID, tokenString, claims.ExpiresAt.Time)
+			return !isRevoked, err
+		})
 
 		c.Next()
 	}
@@ -79,20 +128,31 @@ func (s *Server) setupRoutes() {
 	})
 
 	chat := s.router.Group("/chat")
-	chat.Use(AuthMiddleware(s.jwtSecret))
+	chat.Use(AuthMiddleware(s.jwks, s.revoked, s.keys))
 	{
 		chat.GET("/list", ListChats(s.db))
-		chat.POST("/create", CreateChat(s.db))
-		chat.GET("/:chatid/members/", GetMembers(s.db))
-		chat.POST("/:chatid/members/add", AddMembers(s.db))
-		chat.DELETE("/:chatid/members/remove", RemoveMembers(s.db))
-		chat.DELETE("/:chatid/remove", DeleteChat(s.db))
-		chat.GET("/:chatid/info", GetChatInfo(s.db))
-		chat.PATCH("/:chatid/edit", EditChatInfo(s.db))
-		chat.POST("/:chatid/messages/send", AddMesage(s.db))
-		chat.GET("/:chatid/messages", GetMessages(s.db))
-		chat.DELETE("/:chatid/messages/remove", DeleteMessages(s.db))
-		chat.PATCH("/:chatid/messages/edit", EditMessage(s.db))
+		chat.POST("/create", CreateChat(s.db, s.hub))
+	}
+
+	s.router.GET("/chat/ws", streamToken, AuthMiddleware(s.jwks, s.revoked, s.keys), ServeWS(s.db, s.hub, s.config))
+	s.router.GET("/chat/events", streamToken, AuthMiddleware(s.jwks, s.revoked, s.keys), StreamEvents(s.db, s.hub, s.config))
+
+	member := chat.Group("/:chatid")
+	member.Use(RequireMembership(s.db))
+	{
+		member.GET("/members/", GetMembers(s.db, s.users))
+		member.POST("/members/add", RequireChatPermission(PermAddMembers), AddMembers(s.db, s.hub))
+		member.DELETE("/members/remove", RequireChatPermission(PermRemoveMembers), RemoveMembers(s.db, s.hub))
+		member.PATCH("/members/:userid/role", RequireChatPermission(PermManageRoles), SetMemberRole(s.db, s.hub))
+		member.POST("/transfer", RequireChatPermission(PermTransferOwner), TransferOwnership(s.db, s.hub))
+		member.POST("/leave", LeaveChat(s.db, s.hub))
+		member.DELETE("/remove", RequireChatPermission(PermDeleteChat), DeleteChat(s.db, s.hub))
+		member.GET("/info", GetChatInfo(s.db))
+		member.PATCH("/edit", RequireChatPermission(PermEditChat), EditChatInfo(s.db, s.hub))
+		member.POST("/messages/send", AddMesage(s.db, s.hub))
+		member.GET("/messages", GetMessages(s.db, s.users))
+		member.DELETE("/messages/remove", DeleteMessages(s.db, s.hub))
+		member.PATCH("/messages/edit", EditMessage(s.db, s.hub))
 	}
 
 }
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyPrefix совпадает с префиксом ключей, которые выдаёт authService.
+// Ключ имеет вид 4at_<8 символов>_<43 символа> в base64url.
+const (
+	apiKeyPrefix = "4at_"
+	apiKeyLength = len(apiKeyPrefix) + 8 + 1 + 43
+)
+
+const (
+	// maxAPIKeyMisses — сколько неизвестных ключей один IP может предъявить
+	// за apiKeyMissWindow, прежде чем запросы перестанут уходить в authService.
+	maxAPIKeyMisses  = 20
+	apiKeyMissWindow = time.Minute
+	// maxAPIKeyCache ограничивает кеш, который иначе рос бы от перебора ключей.
+	maxAPIKeyCache = 10000
+)
+
+var ErrTooManyAPIKeyMisses = errors.New("too many invalid api keys")
+
+const (
+	ScopeChatRead  = "chat:read"
+	ScopeChatWrite = "chat:write"
+)
+
+type APIKeyIdentity struct {
+	UserID   string   `json:"user_id"`
+	Username string   `json:"username"`
+	Groups   []string `json:"groups"`
+	Scopes   []string `json:"scopes"`
+}
+
+// APIKeyVerifier проверяет API-ключи через authService и кеширует ответ
+// по хешу ключа, чтобы сам ключ не лежал в памяти дольше запроса.
+type APIKeyVerifier struct {
+	authURL string
+	token   string
+	client  *http.Client
+	ttl     time.Duration
+
+	mu        sync.Mutex
+	cache     map[string]apiKeyEntry
+	misses    map[string]apiKeyMisses
+	lastSweep time.Time
+}
+
+type apiKeyMisses struct {
+	count int
+	reset time.Time
+}
+
+type apiKeyEntry struct {
+	identity *APIKeyIdentity
+	until    time.Time
+}
+
+func NewAPIKeyVerifier(authURL, token string, ttl time.Duration) *APIKeyVerifier {
+	return &APIKeyVerifier{
+		authURL: authURL,
+		token:   token,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		ttl:     ttl,
+		cache:   make(map[string]apiKeyEntry),
+		misses:  make(map[string]apiKeyMisses),
+	}
+}
+
+// Verify возвращает владельца ключа или nil, если ключ недействителен.
+// Ключ неверного вида отклоняется без обращения к authService, а IP,
+// перебирающий ключи, получает ErrTooManyAPIKeyMisses.
+func (v *APIKeyVerifier) Verify(ctx context.Context, key, ip string) (*APIKeyIdentity, error) {
+	if !wellFormedAPIKey(key) {
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+
+	now := time.Now()
+	v.mu.Lock()
+	entry, ok := v.cache[hash]
+	if ok && now.Before(entry.until) {
+		v.mu.Unlock()
+		if entry.identity == nil {
+			return nil, v.miss(ip, now)
+		}
+		return entry.identity, nil
+	}
+	if m := v.misses[ip]; m.count >= maxAPIKeyMisses && now.Before(m.reset) {
+		v.mu.Unlock()
+		return nil, ErrTooManyAPIKeyMisses
+	}
+	v.mu.Unlock()
+
+	identity, err := v.verify(ctx, key, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	if len(v.cache) >= maxAPIKeyCache || now.Sub(v.lastSweep) > v.ttl {
+		v.sweep(now)
+	}
+	if len(v.cache) < maxAPIKeyCache {
+		v.cache[hash] = apiKeyEntry{identity: identity, until: now.Add(v.ttl)}
+	}
+	v.mu.Unlock()
+
+	if identity == nil {
+		return nil, v.miss(ip, now)
+	}
+	return identity, nil
+}
+
+// miss засчитывает IP неизвестный ключ. Ошибку он получит, только когда
+// исчерпает лимит, до тех пор — обычный отказ.
+func (v *APIKeyVerifier) miss(ip string, now time.Time) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m := v.misses[ip]
+	if !now.Before(m.reset) {
+		m = apiKeyMisses{reset: now.Add(apiKeyMissWindow)}
+	}
+	m.count++
+	v.misses[ip] = m
+	if m.count > maxAPIKeyMisses {
+		return ErrTooManyAPIKeyMisses
+	}
+	return nil
+}
+
+// sweep убирает устаревшие записи кеша и счётчиков. Вызывается под mu.
+func (v *APIKeyVerifier) sweep(now time.Time) {
+	for k, e := range v.cache {
+		if !now.Before(e.until) {
+			delete(v.cache, k)
+		}
+	}
+	for ip, m := range v.misses {
+		if !now.Before(m.reset) {
+			delete(v.misses, ip)
+		}
+	}
+	v.lastSweep = now
+}
+
+func wellFormedAPIKey(key string) bool {
+	if len(key) != apiKeyLength || !strings.HasPrefix(key, apiKeyPrefix) || key[len(apiKeyPrefix)+8] != '_' {
+		return false
+	}
+	for _, r := range key[len(apiKeyPrefix):] {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *APIKeyVerifier) verify(ctx context.Context, key, ip string) (*APIKeyIdentity, error) {
+	body, err := json.Marshal(map[string]string{"key": key, "ip": ip})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.authURL+"/auth/api-keys/verify", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+v.token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach auth service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth service returned %s", resp.Status)
+	}
+
+	var result struct {
+		Active bool `json:"active"`
+		APIKeyIdentity
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode api key response: %w", err)
+	}
+	if !result.Active {
+		return nil, nil
+	}
+	return &result.APIKeyIdentity, nil
+}
+
+// apiKeyFromRequest достаёт ключ из X-API-Key или из Authorization: Bearer 4at_...
+func apiKeyFromRequest(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		return token
+	}
+	return ""
+}
+
+// requiredScope — чтение доступно с chat:read, всё остальное требует chat:write.
+func requiredScope(method string) string {
+	if method == http.MethodGet || method == http.MethodHead {
+		return ScopeChatRead
+	}
+	return ScopeChatWrite
+}
+
+func authenticateAPIKey(c *gin.Context, keys *APIKeyVerifier, key string) {
+	if keys == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API keys are not enabled"})
+		return
+	}
+
+	identity, err := keys.Verify(c.Request.Context(), key, c.ClientIP())
+	if errors.Is(err, ErrTooManyAPIKeyMisses) {
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Слишком много неверных ключей, попробуйте позже"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to verify API key: %v", err)
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Auth service unavailable"})
+		return
+	}
+	if identity == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		return
+	}
+
+	scope := requiredScope(c.Request.Method)
+	if !slices.Contains(identity.Scopes, scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Ключу не хватает прав: " + scope})
+		return
+	}
+
+	c.Set("user_id", identity.UserID)
+	c.Set("username", identity.Username)
+	c.Set("groups", identity.Groups)
+	c.Set("scopes", identity.Scopes)
+	c.Set("api_key", true)
+	ip := c.ClientIP()
+	setSession(c, time.Time{}, func(ctx context.Context) (bool, error) {
+		identity, err := keys.Verify(ctx, key, ip)
+		return identity != nil, err
+	})
+	c.Next()
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"chatService/outbox"
+	"eventBus/bus"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// DeletionAnonymize оставляет сообщения удалённого пользователя,
+	// но отвязывает их от него.
+	DeletionAnonymize = "anonymize"
+	// DeletionDelete удаляет сообщения вместе с пользователем.
+	DeletionDelete = "delete"
+
+	eventUserDeleted = "user.deleted"
+)
+
+// deletedUserID — автор, которому передаются обезличенные сообщения.
+var deletedUserID = uuid.Nil
+
+// maxAnonymizedEvents — сколько обезличенных сообщений одного чата
+// сообщается по одному. Если их больше, клиенты получают chat.resync
+// и перечитывают чат целиком.
+const maxAnonymizedEvents = 100
+
+// RegisterEventHandlers подписывает чат на события authService.
+func RegisterEventHandlers(consumer *outbox.Consumer, hub *Hub, config Config) {
+	consumer.Handle(eventUserDeleted, func(ctx context.Context, tx pgx.Tx, event bus.Event) error {
+		events, err := handleUserDeleted(ctx, tx, event.Payload, config.DeletionPolicy)
+		if err != nil {
+			return err
+		}
+		outbox.AfterCommit(ctx, func() { hub.Publish(ctx, events...) })
+		return nil
+	})
+}
+
+// handleUserDeleted убирает пользователя из чатов и возвращает записанные
+// в журнал события, которые нужно разослать после коммита.
+func handleUserDeleted(ctx context.Context, tx pgx.Tx, payload json.RawMessage, policy string) ([]ChatEvent, error) {
+	var data struct {
+		UserID uuid.UUID `json:"user_id"`
+	}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil, fmt.Errorf("invalid user.deleted payload: %w", err)
+	}
+	if data.UserID == uuid.Nil {
+		return nil, fmt.Errorf("user.deleted without user_id")
+	}
+
+	rows, err := tx.Query(ctx, "DELETE FROM user_chat WHERE user_id = $1 RETURNING chat_id, role", data.UserID)
+	if err != nil {
+		return nil, err
+	}
+	var chats, owned []uuid.UUID
+	for rows.Next() {
+		var chatID uuid.UUID
+		var role string
+		if err := rows.Scan(&chatID, &role); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		chats = append(chats, chatID)
+		if role == RoleOwner {
+			owned = append(owned, chatID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []ChatEvent
+	record := func(event ChatEvent) error {
+		event, err := recordEvent(ctx, tx, event)
+		if err == nil {
+			events = append(events, event)
+		}
+		return err
+	}
+	for _, chatID := range chats {
+		if err := record(newChatEvent(EventMemberRemoved, chatID, membersData{UserIDs: []uuid.UUID{data.UserID}})); err != nil {
+			return nil, err
+		}
+	}
+	// Чаты удалённого владельца переходят к преемнику, как при выходе.
+	for _, chatID := range owned {
+		if err := lockChat(ctx, tx, chatID); err != nil {
+			return nil, err
+		}
+		owner, err := ensureOwner(ctx, tx, chatID)
+		if err != nil {
+			return nil, err
+		}
+		if owner != uuid.Nil {
+			if err := record(newChatEvent(EventMemberUpdated, chatID, gin.H{"user_id": owner, "role": RoleOwner})); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if policy == DeletionDelete {
+		rows, err = tx.Query(ctx, "DELETE FROM messages WHERE user_id = $1 RETURNING chat_id, id", data.UserID)
+	} else {
+		rows, err = tx.Query(ctx, "UPDATE messages SET user_id = $2 WHERE user_id = $1 RETURNING chat_id, id", data.UserID, deletedUserID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	touched := make(map[uuid.UUID][]int64)
+	var order []uuid.UUID
+	for rows.Next() {
+		var chatID uuid.UUID
+		var id int64
+		if err := rows.Scan(&chatID, &id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if _, ok := touched[chatID]; !ok {
+			order = append(order, chatID)
+		}
+		touched[chatID] = append(touched[chatID], id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, chatID := range order {
+		ids := touched[chatID]
+		var err error
+		switch {
+		case policy == DeletionDelete:
+			err = record(newChatEvent(EventMessageDeleted, chatID, gin.H{"ids": ids}))
+		case len(ids) > maxAnonymizedEvents:
+			err = record(newChatEvent(EventChatResync, chatID, nil))
+		default:
+			for _, id := range ids {
+				if err = record(newChatEvent(EventMessageEdited, chatID, rowRef{ID: id})); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
@@ -2,12 +2,16 @@ package server
 
 import (
 	"chatService/db"
+	"chatService/outbox"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
 type Chat struct {
@@ -17,6 +21,9 @@ type Chat struct {
 	Created_at time.Time `json:"created_at"`
 }
 
+// chatColumns перечисляет поля Chat явно: у chats есть служебные столбцы.
+const chatColumns = "c.id, c.name, COALESCE(c.pic, ''), c.created_at"
+
 type Message struct {
 	Id         int64     `json:"id"`
 	Chat_ID    uuid.UUID `json:"chat_id"`
@@ -26,19 +33,24 @@ type Message struct {
 	Created_at time.Time `json:"created_at"`
 }
 
+// internalError отвечает 500 без подробностей: текст ошибки базы может
+// раскрыть схему или чужие данные, поэтому он остаётся только в логе.
+func internalError(c *gin.Context, err error) {
+	log.Printf("%s %s failed: %v", c.Request.Method, c.FullPath(), err)
+	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Внутренняя ошибка сервера"})
+}
+
 func ListChats(db *db.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.GetString("user_id")
 		rows, err := db.Pool.Query(c, `
-			SELECT c.*
+			SELECT `+chatColumns+`
 			FROM chats c
 			JOIN user_chat uc ON uc.chat_id = c.id
 			WHERE uc.user_id = $1
 		`, userID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": err.Error(),
-			})
+			internalError(c, err)
 			return
 		}
 		defer rows.Close()
@@ -46,9 +58,7 @@ func ListChats(db *db.Database) gin.HandlerFunc {
 		for rows.Next() {
 			var chat Chat
 			if err := rows.Scan(&chat.Id, &chat.Name, &chat.Pic, &chat.Created_at); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"error": err.Error(),
-				})
+				internalError(c, err)
 				return
 			}
 			chats = append(chats, chat)
@@ -58,24 +68,31 @@ func ListChats(db *db.Database) gin.HandlerFunc {
 	}
 }
 
-func CreateChat(db *db.Database) gin.HandlerFunc {
+func CreateChat(db *db.Database, hub *Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
 			Name string  `json:"name" binding:"required"`
 			Pic  *string `json:"pic"`
 		}
 		userID := c.GetString("user_id")
-		fmt.Printf("userid: %s", userID)
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		defer tx.Rollback(ctx)
+
 		var chat Chat
-		err := db.Pool.QueryRow(
-			c.Request.Context(),
-			`INSERT INTO chats (name, pic)
+		err = tx.QueryRow(
+			ctx,
+			`INSERT INTO chats AS c (name, pic)
 			VALUES ($1, $2)
-			RETURNING *`,
+			RETURNING `+chatColumns,
 			req.Name, req.Pic,
 		).Scan(
 			&chat.Id,
@@ -84,17 +101,17 @@ func CreateChat(db *db.Database) gin.HandlerFunc {
 			&chat.Created_at,
 		)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			internalError(c, err)
 			return
 		}
 
-		cmdTag, err := db.Pool.Exec(
-			c.Request.Context(),
-			`INSERT INTO user_chat (user_id, chat_id)
-			VALUES ($1, $2)
-			`, c.GetString("user_id"), chat.Id)
+		cmdTag, err := tx.Exec(
+			ctx,
+			`INSERT INTO user_chat (user_id, chat_id, role)
+			VALUES ($1, $2, $3)
+			`, c.GetString("user_id"), chat.Id, RoleOwner)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			internalError(c, err)
 			return
 		}
 		if cmdTag.RowsAffected() == 0 {
@@ -102,20 +119,51 @@ func CreateChat(db *db.Database) gin.HandlerFunc {
 			return
 		}
 
+		creator, _ := uuid.Parse(userID)
+		if err := outbox.Enqueue(ctx, tx, outbox.TypeChatCreated, outbox.ChatCreated{ChatID: chat.Id, CreatedBy: creator}); err != nil {
+			internalError(c, err)
+			return
+		}
+		// Другие подключения создателя начинают получать события нового чата.
+		event, err := recordEvent(ctx, tx, newChatEvent(EventMemberAdded, chat.Id, membersData{UserIDs: []uuid.UUID{creator}}))
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if err := tx.Commit(ctx); err != nil {
+			internalError(c, err)
+			return
+		}
+
+		hub.Publish(ctx, event)
 		c.JSON(http.StatusOK, gin.H{"chat": chat, "userID": userID})
 	}
 }
 
-func DeleteChat(db *db.Database) gin.HandlerFunc {
+func DeleteChat(db *db.Database, hub *Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		chatID := c.Param("chatid")
-		cmdTag, err := db.Pool.Exec(
-			c.Request.Context(),
+		chatID := membership(c).ChatID
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		// Номер событию выдаётся, пока чат ещё есть; журнал переживает чат.
+		event, err := recordEvent(ctx, tx, newChatEvent(EventChatDeleted, chatID, gin.H{"chat_id": chatID}))
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		cmdTag, err := tx.Exec(
+			ctx,
 			`DELETE FROM chats WHERE id = $1`,
 			chatID,
 		)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			internalError(c, err)
 			return
 		}
 
@@ -124,112 +172,210 @@ func DeleteChat(db *db.Database) gin.HandlerFunc {
 			return
 		}
 
+		if err := outbox.Enqueue(ctx, tx, outbox.TypeChatDeleted, outbox.ChatDeleted{ChatID: chatID}); err != nil {
+			internalError(c, err)
+			return
+		}
+		if err := tx.Commit(ctx); err != nil {
+			internalError(c, err)
+			return
+		}
+
+		hub.Publish(ctx, event)
 		c.Status(http.StatusOK)
 	}
 }
 
-func GetMembers(db *db.Database) gin.HandlerFunc {
+func GetMembers(db *db.Database, users *UserDirectory) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		chatID := c.Param("chatid")
+		chatID := membership(c).ChatID
 		rows, err := db.Pool.Query(c, `
-			SELECT uc.user_id
+			SELECT uc.user_id, uc.role
 			FROM user_chat uc
 			WHERE uc.chat_id = $1
+			ORDER BY uc.joined_at, uc.user_id
 		`, chatID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": err.Error(),
-			})
+			internalError(c, err)
 			return
 		}
 		defer rows.Close()
 		members := make([]uuid.UUID, 0)
+		roles := make(map[uuid.UUID]string)
 		for rows.Next() {
 			var member uuid.UUID
-			if err := rows.Scan(&member); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"error": err.Error(),
-				})
+			var role string
+			if err := rows.Scan(&member, &role); err != nil {
+				internalError(c, err)
 				return
 			}
 			members = append(members, member)
+			roles[member] = role
 		}
 
-		c.JSON(http.StatusOK, gin.H{"members": members})
+		response := gin.H{"members": members, "roles": roles}
+		includeUsers(c, users, response, members)
+		c.JSON(http.StatusOK, response)
 	}
 }
 
-func AddMembers(db *db.Database) gin.HandlerFunc {
+func AddMembers(db *db.Database, hub *Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
 			Members []uuid.UUID `json:"members" binding:"required"`
 		}
-		chatID := c.Param("chatid")
+		chatID := membership(c).ChatID
 
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		cmdTag, err := db.Pool.Exec(c.Request.Context(),
-			"INSERT INTO user_chat (chat_id, user_id) SELECT $1, unnest($2::uuid[])",
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		rows, err := tx.Query(ctx,
+			`INSERT INTO user_chat (chat_id, user_id)
+			SELECT $1, unnest($2::uuid[])
+			ON CONFLICT DO NOTHING
+			RETURNING user_id`,
 			chatID, req.Members,
 		)
+		var added []uuid.UUID
+		if err == nil {
+			added, err = pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Ошибка при связывании пользователей с чатом: %s", err)})
+			internalError(c, err)
+			return
+		}
+
+		var events []ChatEvent
+		if len(added) > 0 {
+			event, err := recordEvent(ctx, tx, newChatEvent(EventMemberAdded, chatID, membersData{UserIDs: added}))
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			events = append(events, event)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			internalError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, cmdTag.RowsAffected())
+		hub.Publish(ctx, events...)
+		c.JSON(http.StatusOK, len(added))
 	}
 }
 
-func RemoveMembers(db *db.Database) gin.HandlerFunc {
+func RemoveMembers(db *db.Database, hub *Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
 			Members []uuid.UUID `json:"members" binding:"required"`
 		}
-		chatID := c.Param("chatid")
+		chatID := membership(c).ChatID
 
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		cmdTag, err := db.Pool.Exec(c.Request.Context(),
+		m := membership(c)
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		if err := lockChat(ctx, tx, chatID); err != nil {
+			internalError(c, err)
+			return
+		}
+		// Роль из middleware могла устареть, пока ждали блокировку.
+		callerRole, err := memberRole(ctx, tx, chatID, m.UserID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			internalError(c, err)
+			return
+		}
+		caller := &Membership{ChatID: chatID, UserID: m.UserID, Role: callerRole}
+		if err != nil || !caller.Can(PermRemoveMembers) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Недостаточно прав в этом чате"})
+			return
+		}
+
+		// Удалить можно только тех, кто ниже по роли; сам себя участник
+		// выводит через /leave.
+		below := make([]string, 0, len(roleRank))
+		for role := range roleRank {
+			if caller.Outranks(role) {
+				below = append(below, role)
+			}
+		}
+
+		rows, err := tx.Query(ctx,
 			`DELETE FROM user_chat
 			WHERE chat_id = $1
-			AND user_id = ANY($2::uuid[])`,
-			chatID, req.Members,
+			AND user_id = ANY($2::uuid[])
+			AND role = ANY($3)
+			RETURNING user_id`,
+			chatID, req.Members, below,
 		)
+		var removed []uuid.UUID
+		if err == nil {
+			removed, err = pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Ошибка при связывании пользователей с чатом: %s", err)})
+			internalError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, cmdTag.RowsAffected())
+		var events []ChatEvent
+		if len(removed) > 0 {
+			event, err := recordEvent(ctx, tx, newChatEvent(EventMemberRemoved, chatID, membersData{UserIDs: removed}))
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			events = append(events, event)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			internalError(c, err)
+			return
+		}
+
+		hub.Publish(ctx, events...)
+		c.JSON(http.StatusOK, len(removed))
 	}
 }
 
 func GetChatInfo(db *db.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		chatID := c.Param("chatid")
+		chatID := membership(c).ChatID
 		var chat Chat
 		err := db.Pool.QueryRow(c, `
-			SELECT *
+			SELECT `+chatColumns+`
 			FROM chats c
 			WHERE c.id = $1
 		`, chatID).Scan(&chat.Id, &chat.Name, &chat.Pic, &chat.Created_at)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			internalError(c, err)
+			return
 		}
 		c.JSON(http.StatusOK, gin.H{"chat": chat})
 	}
 }
 
-func EditChatInfo(db *db.Database) gin.HandlerFunc {
+func EditChatInfo(db *db.Database, hub *Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		chatID := c.Param("chatid")
+		chatID := membership(c).ChatID
 		var chat Chat
 		var req struct {
 			Name *string `json:"name"`
@@ -239,26 +385,44 @@ func EditChatInfo(db *db.Database) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		fmt.Printf("name: %s, pic: %s", *req.Name, *req.Pic)
-		err := db.Pool.QueryRow(c, `
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		err = tx.QueryRow(ctx, `
 			UPDATE chats c
 			SET
 				name = COALESCE($1, name),
 				pic = COALESCE($2, pic)
 			WHERE c.id = $3
-			RETURNING c.*
-		`, *req.Name, *req.Pic, chatID).Scan(&chat.Id, &chat.Name, &chat.Pic, &chat.Created_at)
+			RETURNING `+chatColumns+`
+		`, req.Name, req.Pic, chatID).Scan(&chat.Id, &chat.Name, &chat.Pic, &chat.Created_at)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		event, err := recordEvent(ctx, tx, newChatEvent(EventChatUpdated, chat.Id, nil))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			internalError(c, err)
+			return
+		}
+		if err := tx.Commit(ctx); err != nil {
+			internalError(c, err)
+			return
 		}
+		hub.Publish(ctx, event)
 		c.JSON(http.StatusOK, gin.H{"chat": chat})
 	}
 }
 
-func AddMesage(db *db.Database) gin.HandlerFunc {
+func AddMesage(db *db.Database, hub *Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		chatID := c.Param("chatid")
-		userID := c.GetString(("user_id"))
+		chatID := membership(c).ChatID
+		userID := membership(c).UserID
 		var req struct {
 			Text    string `json:"text" binding:"required"`
 			Content string `json:"content"`
@@ -267,21 +431,46 @@ func AddMesage(db *db.Database) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		defer tx.Rollback(ctx)
+
 		var msg Message
-		err := db.Pool.QueryRow(c, `
+		err = tx.QueryRow(ctx, `
 			INSERT INTO messages (chat_id, user_id, text, content)
 			VALUES ($1, $2, $3, $4)
 			RETURNING *`, chatID, userID, req.Text, req.Content).Scan(&msg.Id, &msg.Chat_ID, &msg.User_ID, &msg.Text, &msg.Content, &msg.Created_at)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			internalError(c, err)
+			return
+		}
+		err = outbox.Enqueue(ctx, tx, outbox.TypeMessageSent,
+			outbox.MessageSent{MessageID: msg.Id, ChatID: msg.Chat_ID, UserID: msg.User_ID})
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		event, err := recordEvent(ctx, tx, newChatEvent(EventMessageCreated, msg.Chat_ID, rowRef{ID: msg.Id}))
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if err := tx.Commit(ctx); err != nil {
+			internalError(c, err)
+			return
 		}
+		hub.Publish(ctx, event)
 		c.JSON(http.StatusOK, gin.H{"message": msg})
 	}
 }
 
-func GetMessages(db *db.Database) gin.HandlerFunc {
+func GetMessages(db *db.Database, users *UserDirectory) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		chatID := c.Param("chatid")
+		chatID := membership(c).ChatID
 		page := c.Query("page")
 		limit := c.Query("limit")
 		rows, err := db.Pool.Query(c, `
@@ -293,9 +482,7 @@ func GetMessages(db *db.Database) gin.HandlerFunc {
 			OFFSET $3;
 		`, chatID, limit, page)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error1": err.Error(),
-			})
+			internalError(c, err)
 			return
 		}
 		defer rows.Close()
@@ -303,22 +490,25 @@ func GetMessages(db *db.Database) gin.HandlerFunc {
 		for rows.Next() {
 			var msg Message
 			if err := rows.Scan(&msg.Id, &msg.Chat_ID, &msg.User_ID, &msg.Text, &msg.Content, &msg.Created_at); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"error2": err.Error(),
-				})
+				internalError(c, err)
 				return
 			}
 			messages = append(messages, msg)
 		}
 
-		c.JSON(http.StatusOK, gin.H{"messages": messages})
+		response := gin.H{"messages": messages}
+		authors := make([]uuid.UUID, 0, len(messages))
+		for _, msg := range messages {
+			authors = append(authors, msg.User_ID)
+		}
+		includeUsers(c, users, response, authors)
+		c.JSON(http.StatusOK, response)
 	}
 }
 
-func DeleteMessages(db *db.Database) gin.HandlerFunc {
+func DeleteMessages(db *db.Database, hub *Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		chatID := c.Param("chatid")
-		// userID := c.GetString(("user_id"))
+		m := membership(c)
 		var req struct {
 			Messages []int64 `json:"messages" binding:"required"`
 		}
@@ -326,23 +516,56 @@ func DeleteMessages(db *db.Database) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		cmdTag, err := db.Pool.Exec(c.Request.Context(),
+		// Без права удалять чужие сообщения удаляются только свои.
+		var author *uuid.UUID
+		if !m.Can(PermDeleteMessages) {
+			author = &m.UserID
+		}
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		rows, err := tx.Query(ctx,
 			`DELETE FROM messages
 			WHERE chat_id = $1
-			AND id = ANY($2)`,
-			chatID, req.Messages,
+			AND id = ANY($2)
+			AND ($3::uuid IS NULL OR user_id = $3)
+			RETURNING id`,
+			m.ChatID, req.Messages, author,
 		)
+		var deleted []int64
+		if err == nil {
+			deleted, err = pgx.CollectRows(rows, pgx.RowTo[int64])
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Ошибка при удалении сообщений: %s", err)})
+			internalError(c, err)
+			return
+		}
+		var events []ChatEvent
+		if len(deleted) > 0 {
+			event, err := recordEvent(ctx, tx, newChatEvent(EventMessageDeleted, m.ChatID, gin.H{"ids": deleted}))
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			events = append(events, event)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			internalError(c, err)
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Удалено сообщений: %d", cmdTag.RowsAffected())})
+		hub.Publish(ctx, events...)
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Удалено сообщений: %d", len(deleted))})
 	}
 }
 
-func EditMessage(db *db.Database) gin.HandlerFunc {
+func EditMessage(db *db.Database, hub *Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		chatID := c.Param("chatid")
+		m := membership(c)
 		msgID := c.Query("id")
 		var msg Message
 		var req struct {
@@ -353,17 +576,40 @@ func EditMessage(db *db.Database) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		err := db.Pool.QueryRow(c, `
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		err = tx.QueryRow(ctx, `
 			UPDATE messages m
 			SET
 				text = COALESCE($1, text),
 				content = COALESCE($2, content)
-			WHERE m.id = $3 AND m.chat_id = $4
+			WHERE m.id = $3 AND m.chat_id = $4 AND m.user_id = $5
 			RETURNING m.*
-		`, *req.Text, *req.Content, msgID, chatID).Scan(&msg.Id, &msg.Chat_ID, &msg.User_ID, &msg.Text, &msg.Content, &msg.Created_at)
+		`, req.Text, req.Content, msgID, m.ChatID, m.UserID).Scan(&msg.Id, &msg.Chat_ID, &msg.User_ID, &msg.Text, &msg.Content, &msg.Created_at)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "message not found"})
+			return
+		}
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		event, err := recordEvent(ctx, tx, newChatEvent(EventMessageEdited, msg.Chat_ID, rowRef{ID: msg.Id}))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			internalError(c, err)
+			return
+		}
+		if err := tx.Commit(ctx); err != nil {
+			internalError(c, err)
+			return
 		}
+		hub.Publish(ctx, event)
 		c.JSON(http.StatusOK, gin.H{"message": msg})
 	}
 }
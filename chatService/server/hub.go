@@ -0,0 +1,440 @@
+package server
+
+import (
+	"chatService/db"
+	"chatService/pubsub"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Типы событий, которые получают клиенты в реальном времени.
+const (
+	EventMessageCreated = "message.created"
+	EventMessageEdited  = "message.edited"
+	EventMessageDeleted = "message.deleted"
+	EventMemberAdded    = "member.added"
+	EventMemberRemoved  = "member.removed"
+	EventMemberUpdated  = "member.updated"
+	EventChatUpdated    = "chat.updated"
+	EventChatDeleted    = "chat.deleted"
+)
+
+// EventChatResync сообщает клиенту, что пропущенные события чата уже
+// удалены из журнала и чат нужно перечитать целиком.
+const EventChatResync = "chat.resync"
+
+type ChatEvent struct {
+	Type   string    `json:"type"`
+	ChatID uuid.UUID `json:"chat_id"`
+	// Seq — номер события в чате, растёт без пропусков. Нулевой он только
+	// у события чата, который удалили раньше, чем событие успели записать.
+	Seq  int64           `json:"seq"`
+	Data json.RawMessage `json:"data"`
+}
+
+// membersData — данные событий member.added и member.removed.
+type membersData struct {
+	UserIDs []uuid.UUID `json:"user_ids"`
+}
+
+// rowRef — данные события, пока оно идёт между экземплярами: вместо
+// сообщения или чата передаётся только ключ строки.
+type rowRef struct {
+	ID int64 `json:"id"`
+}
+
+// hubChannel — канал pubsub, через который экземпляры обмениваются событиями.
+const hubChannel = "chat_events"
+
+// notification — то, что уходит в pubsub: только ключ события в журнале.
+// Данные любого размера читаются из chat_events, так что уведомление
+// всегда помещается в NOTIFY.
+type notification struct {
+	ChatID uuid.UUID `json:"chat_id"`
+	Seq    int64     `json:"seq"`
+}
+
+func newChatEvent(eventType string, chatID uuid.UUID, data any) ChatEvent {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", eventType, err)
+		raw = json.RawMessage("null")
+	}
+	return ChatEvent{Type: eventType, ChatID: chatID, Data: raw}
+}
+
+// Subscriber — одно подключение клиента. События копятся в буфере
+// фиксированного размера; если клиент не успевает их забирать, хаб
+// отключает его, а не тормозит остальных.
+type Subscriber struct {
+	UserID uuid.UUID
+
+	events chan ChatEvent
+	done   chan struct{}
+	once   sync.Once
+	chats  map[uuid.UUID]struct{}
+}
+
+func (s *Subscriber) Events() <-chan ChatEvent {
+	return s.events
+}
+
+// Done закрывается, когда хаб отключил подписчика за медлительность.
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscriber) drop() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// Hub рассылает события чатов подключённым участникам. События проходят
+// через pubsub, поэтому их получают клиенты всех экземпляров сервиса.
+type Hub struct {
+	db *db.Database
+	ps pubsub.PubSub
+
+	mu    sync.Mutex
+	chats map[uuid.UUID]map[*Subscriber]struct{}
+	users map[uuid.UUID]map[*Subscriber]struct{}
+}
+
+func NewHub(db *db.Database, ps pubsub.PubSub) *Hub {
+	return &Hub{
+		db:    db,
+		ps:    ps,
+		chats: make(map[uuid.UUID]map[*Subscriber]struct{}),
+		users: make(map[uuid.UUID]map[*Subscriber]struct{}),
+	}
+}
+
+// Start подписывает хаб на события всех экземпляров.
+func (h *Hub) Start(ctx context.Context) error {
+	return h.ps.Subscribe(ctx, hubChannel, func(ctx context.Context, payload []byte) {
+		var n notification
+		if err := json.Unmarshal(payload, &n); err != nil {
+			log.Printf("Malformed chat event notification: %v", err)
+			return
+		}
+		if !h.hasConnections() {
+			return
+		}
+		event, err := h.load(ctx, n)
+		if err != nil {
+			log.Printf("Failed to load event %d of chat %s: %v", n.Seq, n.ChatID, err)
+			return
+		}
+		if !h.hasSubscribers(event) {
+			return
+		}
+		if err := h.hydrate(ctx, &event); err != nil {
+			log.Printf("Failed to load %s event for chat %s: %v", event.Type, event.ChatID, err)
+			return
+		}
+		h.dispatch(event)
+	})
+}
+
+// recordEvent выдаёт событию следующий номер в чате и сохраняет его со
+// ссылками вместо данных в транзакции обработчика: событие появляется
+// в журнале вместе с изменением, которое описывает, или не появляется
+// вовсе. Строка чата остаётся заблокированной до коммита, поэтому номер
+// N+1 видят только после номера N.
+func recordEvent(ctx context.Context, tx pgx.Tx, event ChatEvent) (ChatEvent, error) {
+	err := tx.QueryRow(ctx,
+		`WITH next AS (
+			UPDATE chats SET event_seq = event_seq + 1 WHERE id = $1 RETURNING id, event_seq
+		)
+		INSERT INTO chat_events (chat_id, seq, type, data)
+		SELECT id, event_seq, $2, $3 FROM next
+		RETURNING seq`,
+		event.ChatID, event.Type, event.Data,
+	).Scan(&event.Seq)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Чат уже удалён, событие уходит без номера.
+		return event, nil
+	}
+	return event, err
+}
+
+// Publish рассылает события, записанные recordEvent, всем экземплярам
+// после коммита. В уведомлении только номер события, остальное получатели
+// читают из журнала. Ошибка только логируется: событие уже в журнале,
+// и клиенты дочитают его при следующем событии чата или переподключении.
+// Хаб допускает nil, чтобы обработчики работали и без реального времени.
+func (h *Hub) Publish(ctx context.Context, events ...ChatEvent) {
+	if h == nil {
+		return
+	}
+	for _, event := range events {
+		if event.Seq == 0 {
+			// Не записано в журнал: чат удалён, и о нём уже сообщил chat.deleted.
+			continue
+		}
+		payload, err := json.Marshal(notification{ChatID: event.ChatID, Seq: event.Seq})
+		if err == nil {
+			err = h.ps.Publish(ctx, hubChannel, payload)
+		}
+		if err != nil {
+			log.Printf("Failed to publish %s event for chat %s: %v", event.Type, event.ChatID, err)
+		}
+	}
+}
+
+// replay возвращает сохранённые события чата с номерами после after.
+// Если часть из них уже удалена из журнала, вместо них приходит
+// chat.resync. События о сообщениях, которых больше нет, пропускаются.
+func (h *Hub) replay(ctx context.Context, chatID uuid.UUID, after, upto int64) ([]ChatEvent, error) {
+	rows, err := h.db.Pool.Query(ctx,
+		`SELECT chat_id, seq, type, data
+		 FROM chat_events
+		 WHERE chat_id = $1 AND seq > $2 AND seq <= $3
+		 ORDER BY seq`,
+		chatID, after, upto,
+	)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ChatEvent, error) {
+		var e ChatEvent
+		err := row.Scan(&e.ChatID, &e.Seq, &e.Type, &e.Data)
+		return e, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]ChatEvent, 0, len(stored)+1)
+	if len(stored) == 0 || stored[0].Seq != after+1 {
+		events = append(events, newChatEvent(EventChatResync, chatID, nil))
+		if len(stored) > 0 {
+			events[0].Seq = stored[0].Seq - 1
+		} else {
+			events[0].Seq = upto
+		}
+	}
+	for _, e := range stored {
+		if err := h.hydrate(ctx, &e); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				continue
+			}
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// RunPruning удаляет из журнала события старше retention, а вместе с ними
+// и снимки позиций SSE-потоков: по ним уже нечего дочитывать.
+func (h *Hub) RunPruning(ctx context.Context, retention, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cutoff := time.Now().Add(-retention)
+			if _, err := h.db.Pool.Exec(ctx, "DELETE FROM chat_events WHERE created_at < $1", cutoff); err != nil {
+				log.Printf("Failed to prune chat events: %v", err)
+			}
+			if _, err := h.db.Pool.Exec(ctx, "DELETE FROM stream_snapshots WHERE created_at < $1", cutoff); err != nil {
+				log.Printf("Failed to prune stream snapshots: %v", err)
+			}
+		}
+	}
+}
+
+// load читает событие из журнала по ключу из уведомления.
+func (h *Hub) load(ctx context.Context, n notification) (ChatEvent, error) {
+	event := ChatEvent{ChatID: n.ChatID, Seq: n.Seq}
+	err := h.db.Pool.QueryRow(ctx,
+		"SELECT type, data FROM chat_events WHERE chat_id = $1 AND seq = $2",
+		n.ChatID, n.Seq,
+	).Scan(&event.Type, &event.Data)
+	return event, err
+}
+
+// hasConnections сообщает, есть ли у экземпляра подключения вообще:
+// без них уведомления не стоит даже читать из журнала.
+func (h *Hub) hasConnections() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.users) > 0
+}
+
+// hasSubscribers отсекает события чатов, в которых у этого экземпляра
+// нет подключений, чтобы не читать для них базу.
+func (h *Hub) hasSubscribers(event ChatEvent) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.chats[event.ChatID]) > 0 {
+		return true
+	}
+	if event.Type != EventMemberAdded {
+		return false
+	}
+	var members membersData
+	if err := json.Unmarshal(event.Data, &members); err != nil {
+		return false
+	}
+	for _, userID := range members.UserIDs {
+		if len(h.users[userID]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hydrate заменяет ссылку на строку её текущим содержимым.
+func (h *Hub) hydrate(ctx context.Context, event *ChatEvent) error {
+	var data any
+	switch event.Type {
+	case EventMessageCreated, EventMessageEdited:
+		var ref rowRef
+		if err := json.Unmarshal(event.Data, &ref); err != nil {
+			return err
+		}
+		var msg Message
+		err := h.db.Pool.QueryRow(ctx,
+			"SELECT * FROM messages WHERE id = $1 AND chat_id = $2",
+			ref.ID, event.ChatID,
+		).Scan(&msg.Id, &msg.Chat_ID, &msg.User_ID, &msg.Text, &msg.Content, &msg.Created_at)
+		if err != nil {
+			return err
+		}
+		data = msg
+	case EventChatUpdated:
+		var chat Chat
+		err := h.db.Pool.QueryRow(ctx,
+			"SELECT "+chatColumns+" FROM chats c WHERE c.id = $1",
+			event.ChatID,
+		).Scan(&chat.Id, &chat.Name, &chat.Pic, &chat.Created_at)
+		if err != nil {
+			return err
+		}
+		data = chat
+	default:
+		return nil
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	event.Data = raw
+	return nil
+}
+
+// Subscribe подписывает подключение на все чаты пользователя.
+func (h *Hub) Subscribe(userID uuid.UUID, chats []uuid.UUID, buffer int) *Subscriber {
+	s := &Subscriber{
+		UserID: userID,
+		events: make(chan ChatEvent, buffer),
+		done:   make(chan struct{}),
+		chats:  make(map[uuid.UUID]struct{}, len(chats)),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	addTo(h.users, userID, s)
+	for _, chatID := range chats {
+		h.join(s, chatID)
+	}
+	return s
+}
+
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for chatID := range s.chats {
+		h.leave(s, chatID)
+	}
+	removeFrom(h.users, s.UserID, s)
+	s.drop()
+}
+
+// dispatch доставляет событие локальным подписчикам чата. Состав
+// получателей меняется вместе с событиями о составе: добавленные
+// участники уже получают member.added, а удалённые ещё получают member.removed.
+func (h *Hub) dispatch(event ChatEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var members membersData
+	if event.Type == EventMemberAdded || event.Type == EventMemberRemoved {
+		if err := json.Unmarshal(event.Data, &members); err != nil {
+			log.Printf("Malformed %s event: %v", event.Type, err)
+		}
+	}
+
+	if event.Type == EventMemberAdded {
+		for _, userID := range members.UserIDs {
+			for s := range h.users[userID] {
+				h.join(s, event.ChatID)
+			}
+		}
+	}
+
+	for s := range h.chats[event.ChatID] {
+		select {
+		case <-s.done:
+			// Уже отключён и ждёт Unsubscribe.
+			continue
+		default:
+		}
+		select {
+		case s.events <- event:
+		default:
+			log.Printf("Dropping slow subscriber of user %s", s.UserID)
+			s.drop()
+		}
+	}
+
+	switch event.Type {
+	case EventMemberRemoved:
+		for _, userID := range members.UserIDs {
+			for s := range h.users[userID] {
+				h.leave(s, event.ChatID)
+			}
+		}
+	case EventChatDeleted:
+		for s := range h.chats[event.ChatID] {
+			h.leave(s, event.ChatID)
+		}
+	}
+}
+
+func (h *Hub) join(s *Subscriber, chatID uuid.UUID) {
+	s.chats[chatID] = struct{}{}
+	addTo(h.chats, chatID, s)
+}
+
+func (h *Hub) leave(s *Subscriber, chatID uuid.UUID) {
+	delete(s.chats, chatID)
+	removeFrom(h.chats, chatID, s)
+}
+
+func addTo(index map[uuid.UUID]map[*Subscriber]struct{}, key uuid.UUID, s *Subscriber) {
+	set, ok := index[key]
+	if !ok {
+		set = make(map[*Subscriber]struct{})
+		index[key] = set
+	}
+	set[s] = struct{}{}
+}
+
+func removeFrom(index map[uuid.UUID]map[*Subscriber]struct{}, key uuid.UUID, s *Subscriber) {
+	delete(index[key], s)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWKS загружает публичные ключи authService и кеширует их.
+// Незнакомый kid вызывает внеочередное обновление, но не чаще minRefresh.
+type JWKS struct {
+	url        string
+	client     *http.Client
+	ttl        time.Duration
+	minRefresh time.Duration
+
+	mu        sync.RWMutex
+	keys      map[string]jwksKey
+	fetchedAt time.Time
+}
+
+type jwksKey struct {
+	method jwt.SigningMethod
+	public crypto.PublicKey
+}
+
+func NewJWKS(url string, ttl time.Duration) *JWKS {
+	return &JWKS{
+		url:        url,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		ttl:        ttl,
+		minRefresh: 10 * time.Second,
+		keys:       make(map[string]jwksKey),
+	}
+}
+
+// Keyfunc подходит для jwt.ParseWithClaims.
+func (j *JWKS) Keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, fmt.Errorf("token has no kid")
+		}
+
+		key, ok, stale := j.lookup(kid)
+		if !ok || stale {
+			if err := j.refresh(ctx, !ok); err != nil {
+				log.Printf("Failed to refresh JWKS: %v", err)
+			}
+			key, ok, _ = j.lookup(kid)
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method != key.method {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.public, nil
+	}
+}
+
+func (j *JWKS) lookup(kid string) (jwksKey, bool, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	key, ok := j.keys[kid]
+	return key, ok, time.Since(j.fetchedAt) > j.ttl
+}
+
+func (j *JWKS) refresh(ctx context.Context, unknownKid bool) error {
+	j.mu.RLock()
+	recent := time.Since(j.fetchedAt) < j.minRefresh
+	j.mu.RUnlock()
+	if recent && unknownKid {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]jwksKey, len(set.Keys))
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "OKP" && k.Crv == "Ed25519" && k.Alg == "EdDSA":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				log.Printf("Skipping malformed JWK %s", k.Kid)
+				continue
+			}
+			keys[k.Kid] = jwksKey{method: jwt.SigningMethodEdDSA, public: ed25519.PublicKey(x)}
+		case k.Kty == "RSA" && k.Alg == "RS256":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				log.Printf("Skipping malformed JWK %s", k.Kid)
+				continue
+			}
+			keys[k.Kid] = jwksKey{method: jwt.SigningMethodRS256, public: &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}}
+		}
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.fetchedAt = time.Now()
+	j.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"chatService/db"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Membership — участие вызывающего пользователя в чате из :chatid.
+type Membership struct {
+	ChatID uuid.UUID
+	UserID uuid.UUID
+	Role   string
+}
+
+// RequireMembership загружает участие пользователя в чате один раз на запрос.
+// Не участнику отвечаем 404, как будто чата нет, чтобы не раскрывать
+// существование чужих чатов.
+func RequireMembership(db *db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		chatID, err := uuid.Parse(c.Param("chatid"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "chat not found"})
+			return
+		}
+		userID, err := uuid.Parse(c.GetString("user_id"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		var role string
+		err = db.Pool.QueryRow(c.Request.Context(),
+			"SELECT role FROM user_chat WHERE chat_id = $1 AND user_id = $2",
+			chatID, userID,
+		).Scan(&role)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "chat not found"})
+			return
+		}
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.Set("membership", &Membership{ChatID: chatID, UserID: userID, Role: role})
+		c.Next()
+	}
+}
+
+// membership возвращает участие, загруженное RequireMembership.
+func membership(c *gin.Context) *Membership {
+	return c.MustGet("membership").(*Membership)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RevocationChecker спрашивает у authService, не отозван ли токен,
+// и кеширует ответ по jti, чтобы не ходить туда на каждый запрос.
+// /auth/introspect открыт только сервисам, поэтому нужен токен сервиса.
+type RevocationChecker struct {
+	authURL      string
+	serviceToken string
+	client       *http.Client
+	ttl          time.Duration
+
+	mu    sync.Mutex
+	cache map[string]revocationEntry
+}
+
+type revocationEntry struct {
+	revoked bool
+	until   time.Time
+}
+
+func NewRevocationChecker(authURL, serviceToken string, ttl time.Duration) *RevocationChecker {
+	return &RevocationChecker{
+		authURL:      authURL,
+		serviceToken: serviceToken,
+		client:       &http.Client{Timeout: 5 * time.Second},
+		ttl:          ttl,
+		cache:        make(map[string]revocationEntry),
+	}
+}
+
+func (r *RevocationChecker) Revoked(ctx context.Context, jti, token string, exp time.Time) (bool, error) {
+	now := time.Now()
+	r.mu.Lock()
+	entry, ok := r.cache[jti]
+	r.mu.Unlock()
+	if ok && now.Before(entry.until) {
+		return entry.revoked, nil
+	}
+
+	revoked, err := r.introspect(ctx, token)
+	if err != nil {
+		return false, err
+	}
+
+	// Отзыв окончателен, поэтому его можно помнить до истечения токена.
+	until := now.Add(r.ttl)
+	if revoked || exp.Before(until) {
+		until = exp
+	}
+
+	r.mu.Lock()
+	r.cache[jti] = revocationEntry{revoked: revoked, until: until}
+	for k, e := range r.cache {
+		if now.After(e.until) {
+			delete(r.cache, k)
+		}
+	}
+	r.mu.Unlock()
+
+	return revoked, nil
+}
+
+func (r *RevocationChecker) introspect(ctx context.Context, token string) (bool, error) {
+	body, err := json.Marshal(map[string]string{"token": token})
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.authURL+"/auth/introspect", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+r.serviceToken)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to reach auth service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("auth service returned %s", resp.Status)
+	}
+
+	var result struct {
+		Active bool `json:"active"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+	return !result.Active, nil
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"chatService/db"
+	"chatService/outbox"
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Роли участника чата. Владелец в чате всегда ровно один.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Действия, которые разрешены не всем участникам.
+const (
+	PermEditChat       = "chat:edit"
+	PermAddMembers     = "members:add"
+	PermRemoveMembers  = "members:remove"
+	PermDeleteMessages = "messages:delete_any"
+	PermDeleteChat     = "chat:delete"
+	PermManageRoles    = "roles:manage"
+	PermTransferOwner  = "chat:transfer"
+)
+
+// chatPermissions — матрица прав. Читать чат, писать в него, править
+// и удалять свои сообщения и выходить из чата может любой участник.
+var chatPermissions = map[string][]string{
+	RoleOwner: {
+		PermEditChat, PermAddMembers, PermRemoveMembers, PermDeleteMessages,
+		PermDeleteChat, PermManageRoles, PermTransferOwner,
+	},
+	RoleAdmin: {
+		PermEditChat, PermAddMembers, PermRemoveMembers, PermDeleteMessages,
+	},
+	RoleMember: {},
+}
+
+// roleRank сравнивает роли: управлять можно только теми, кто ниже.
+var roleRank = map[string]int{RoleMember: 0, RoleAdmin: 1, RoleOwner: 2}
+
+func (m *Membership) Can(permission string) bool {
+	return slices.Contains(chatPermissions[m.Role], permission)
+}
+
+// Outranks сообщает, может ли участник управлять участником с ролью role.
+func (m *Membership) Outranks(role string) bool {
+	return roleRank[m.Role] > roleRank[role]
+}
+
+// RequireChatPermission используется после RequireMembership.
+func RequireChatPermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !membership(c).Can(permission) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Недостаточно прав в этом чате"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// lockChat сериализует изменения состава и ролей одного чата.
+func lockChat(ctx context.Context, tx pgx.Tx, chatID uuid.UUID) error {
+	_, err := tx.Exec(ctx, "SELECT 1 FROM chats WHERE id = $1 FOR UPDATE", chatID)
+	return err
+}
+
+func memberRole(ctx context.Context, tx pgx.Tx, chatID, userID uuid.UUID) (string, error) {
+	var role string
+	err := tx.QueryRow(ctx,
+		"SELECT role FROM user_chat WHERE chat_id = $1 AND user_id = $2",
+		chatID, userID,
+	).Scan(&role)
+	return role, err
+}
+
+// ensureOwner назначает преемника, если владелец ушёл: самого давнего
+// администратора, иначе самого давнего участника. Чат без участников
+// удаляется. Возвращает нового владельца или uuid.Nil.
+func ensureOwner(ctx context.Context, tx pgx.Tx, chatID uuid.UUID) (uuid.UUID, error) {
+	var hasOwner bool
+	err := tx.QueryRow(ctx,
+		"SELECT EXISTS(SELECT 1 FROM user_chat WHERE chat_id = $1 AND role = $2)",
+		chatID, RoleOwner,
+	).Scan(&hasOwner)
+	if err != nil || hasOwner {
+		return uuid.Nil, err
+	}
+
+	var successor uuid.UUID
+	err = tx.QueryRow(ctx,
+		`UPDATE user_chat SET role = $2
+		 WHERE chat_id = $1 AND user_id = (
+			SELECT user_id FROM user_chat
+			WHERE chat_id = $1
+			ORDER BY role = $3 DESC, joined_at, user_id
+			LIMIT 1
+		 )
+		 RETURNING user_id`,
+		chatID, RoleOwner, RoleAdmin,
+	).Scan(&successor)
+	if err == nil {
+		return successor, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, err
+	}
+
+	cmdTag, err := tx.Exec(ctx, "DELETE FROM chats WHERE id = $1", chatID)
+	if err != nil || cmdTag.RowsAffected() == 0 {
+		return uuid.Nil, err
+	}
+	return uuid.Nil, outbox.Enqueue(ctx, tx, outbox.TypeChatDeleted, outbox.ChatDeleted{ChatID: chatID})
+}
+
+// SetMemberRole повышает участника до администратора или понижает обратно.
+// Владелец меняется только через передачу владения.
+func SetMemberRole(db *db.Database, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Role string `json:"role" binding:"required,oneof=admin member"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		targetID, err := uuid.Parse(c.Param("userid"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "member not found"})
+			return
+		}
+		m := membership(c)
+		if targetID == m.UserID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Нельзя изменить собственную роль"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		if err := lockChat(ctx, tx, m.ChatID); err != nil {
+			internalError(c, err)
+			return
+		}
+		// Роль из middleware могла устареть, пока ждали блокировку.
+		callerRole, err := memberRole(ctx, tx, m.ChatID, m.UserID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			internalError(c, err)
+			return
+		}
+		caller := &Membership{ChatID: m.ChatID, UserID: m.UserID, Role: callerRole}
+		if err != nil || !caller.Can(PermManageRoles) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Недостаточно прав в этом чате"})
+			return
+		}
+		current, err := memberRole(ctx, tx, m.ChatID, targetID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "member not found"})
+			return
+		}
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if !caller.Outranks(current) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Недостаточно прав в этом чате"})
+			return
+		}
+
+		_, err = tx.Exec(ctx,
+			"UPDATE user_chat SET role = $3 WHERE chat_id = $1 AND user_id = $2",
+			m.ChatID, targetID, req.Role,
+		)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		event, err := recordEvent(ctx, tx, newChatEvent(EventMemberUpdated, m.ChatID, gin.H{"user_id": targetID, "role": req.Role}))
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if err := tx.Commit(ctx); err != nil {
+			internalError(c, err)
+			return
+		}
+
+		hub.Publish(ctx, event)
+		c.JSON(http.StatusOK, gin.H{"user_id": targetID, "role": req.Role})
+	}
+}
+
+// TransferOwnership делает участника владельцем, прежний владелец
+// остаётся администратором.
+func TransferOwnership(db *db.Database, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			UserID uuid.UUID `json:"user_id" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		m := membership(c)
+		if req.UserID == m.UserID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Вы уже владелец чата"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		if err := lockChat(ctx, tx, m.ChatID); err != nil {
+			internalError(c, err)
+			return
+		}
+		// Роль из middleware могла устареть, пока ждали блокировку.
+		role, err := memberRole(ctx, tx, m.ChatID, m.UserID)
+		if err != nil || role != RoleOwner {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Недостаточно прав в этом чате"})
+			return
+		}
+		if _, err := memberRole(ctx, tx, m.ChatID, req.UserID); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "member not found"})
+				return
+			}
+			internalError(c, err)
+			return
+		}
+
+		// Сначала снимаем старого владельца: уникальный индекс не допускает двух.
+		steps := []struct {
+			user uuid.UUID
+			role string
+		}{{m.UserID, RoleAdmin}, {req.UserID, RoleOwner}}
+		events := make([]ChatEvent, 0, len(steps))
+		for _, step := range steps {
+			_, err := tx.Exec(ctx,
+				"UPDATE user_chat SET role = $3 WHERE chat_id = $1 AND user_id = $2",
+				m.ChatID, step.user, step.role,
+			)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			event, err := recordEvent(ctx, tx, newChatEvent(EventMemberUpdated, m.ChatID, gin.H{"user_id": step.user, "role": step.role}))
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			events = append(events, event)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			internalError(c, err)
+			return
+		}
+
+		hub.Publish(ctx, events...)
+		c.JSON(http.StatusOK, gin.H{"owner": req.UserID})
+	}
+}
+
+// LeaveChat выводит пользователя из чата. Если уходит владелец,
+// владение переходит по правилам ensureOwner.
+func LeaveChat(db *db.Database, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		m := membership(c)
+		ctx := c.Request.Context()
+		tx, err := db.Pool.Begin(ctx)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		if err := lockChat(ctx, tx, m.ChatID); err != nil {
+			internalError(c, err)
+			return
+		}
+		_, err = tx.Exec(ctx, "DELETE FROM user_chat WHERE chat_id = $1 AND user_id = $2", m.ChatID, m.UserID)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		left, err := recordEvent(ctx, tx, newChatEvent(EventMemberRemoved, m.ChatID, membersData{UserIDs: []uuid.UUID{m.UserID}}))
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		events := []ChatEvent{left}
+		owner, err := ensureOwner(ctx, tx, m.ChatID)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if owner != uuid.Nil {
+			event, err := recordEvent(ctx, tx, newChatEvent(EventMemberUpdated, m.ChatID, gin.H{"user_id": owner, "role": RoleOwner}))
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			events = append(events, event)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			internalError(c, err)
+			return
+		}
+
+		hub.Publish(ctx, events...)
+		response := gin.H{"left": m.ChatID}
+		if owner != uuid.Nil {
+			response["new_owner"] = owner
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultRevalidateInterval = 30 * time.Second
+
+// sessionCheck повторно проверяет учётные данные, с которыми открыт поток:
+// false означает, что токен или ключ отозван.
+type sessionCheck func(ctx context.Context) (bool, error)
+
+// setSession запоминает, когда истекают учётные данные запроса и как
+// проверить их отзыв. expires нулевой, если срока нет.
+func setSession(c *gin.Context, expires time.Time, check sessionCheck) {
+	c.Set("session_expires", expires)
+	c.Set("session_check", check)
+}
+
+// watchSession закрывает возвращённый канал, когда учётные данные потока
+// истекают или отзываются: /chat/ws и /chat/events живут дольше токена,
+// которым открыты, и logout иначе до них не доходил бы. Если authService
+// недоступен, поток не рвётся, проверка повторится на следующем шаге.
+func watchSession(ctx context.Context, c *gin.Context, interval time.Duration) <-chan string {
+	if interval <= 0 {
+		interval = defaultRevalidateInterval
+	}
+	expires := c.GetTime("session_expires")
+	check, _ := c.Value("session_check").(sessionCheck)
+	userID := c.GetString("user_id")
+
+	ended := make(chan string, 1)
+	go func() {
+		var expired <-chan time.Time
+		if !expires.IsZero() {
+			timer := time.NewTimer(time.Until(expires))
+			defer timer.Stop()
+			expired = timer.C
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-expired:
+				ended <- "token expired"
+				return
+			case <-ticker.C:
+				if check == nil {
+					continue
+				}
+				valid, err := check(ctx)
+				if err != nil {
+					log.Printf("Failed to revalidate stream of user %s: %v", userID, err)
+					continue
+				}
+				if !valid {
+					ended <- "token revoked"
+					return
+				}
+			}
+		}
+	}()
+	return ended
+}
+
+// streamToken переносит токен в Authorization для /chat/ws и /chat/events:
+// браузер не может передать заголовок ни в WebSocket, ни в EventSource.
+// WebSocket-клиент кладёт токен в Sec-WebSocket-Protocol вторым элементом
+// после "access_token"; EventSource — в ?access_token=, который в логах
+// запросов заменяется на REDACTED.
+func streamToken(c *gin.Context) {
+	if c.GetHeader("Authorization") == "" {
+		if token := tokenFromProtocol(c.GetHeader("Sec-WebSocket-Protocol")); token != "" {
+			c.Request.Header.Set("Authorization", "Bearer "+token)
+		} else if token := c.Query("access_token"); token != "" {
+			c.Request.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	c.Next()
+}
+
+// wsTokenProtocol — подпротокол, который сервер подтверждает клиенту,
+// передавшему токен через Sec-WebSocket-Protocol.
+const wsTokenProtocol = "access_token"
+
+func tokenFromProtocol(header string) string {
+	protocols := strings.Split(header, ",")
+	if len(protocols) < 2 || strings.TrimSpace(protocols[0]) != wsTokenProtocol {
+		return ""
+	}
+	return strings.TrimSpace(protocols[1])
+}
+
+// logFormatter повторяет формат gin по умолчанию, но не пишет токен из
+// ?access_token= в журнал запросов.
+func logFormatter(param gin.LogFormatterParams) string {
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor = param.StatusCodeColor()
+		methodColor = param.MethodColor()
+		resetColor = param.ResetColor()
+	}
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		redactQuery(param.Path),
+		param.ErrorMessage,
+	)
+}
+
+func redactQuery(path string) string {
+	base, rawQuery, ok := strings.Cut(path, "?")
+	if !ok {
+		return path
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return base + "?REDACTED"
+	}
+	if !query.Has("access_token") {
+		return path
+	}
+	query.Set("access_token", "REDACTED")
+	return base + "?" + query.Encode()
+}
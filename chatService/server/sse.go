@@ -0,0 +1,407 @@
+package server
+
+import (
+	"bytes"
+	"chatService/db"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// maxCursorDeltas — сколько чатов может разойтись со снимком позиций,
+// прежде чем поток запишет новый. Держит id события в пределах сотен байт
+// при любом числе чатов у пользователя.
+const maxCursorDeltas = 16
+
+// removedFromCursor отмечает в отличиях от снимка чат, из которого
+// пользователь вышел или который удалён.
+const removedFromCursor = -1
+
+// eventCursor — номер последнего доставленного события в каждом чате.
+type eventCursor map[uuid.UUID]int64
+
+// marshal записывает позиции по порядку чатов: uuid и uvarint(seq+1),
+// ноль означает removedFromCursor.
+func (c eventCursor) marshal() []byte {
+	chats := make([]uuid.UUID, 0, len(c))
+	for chatID := range c {
+		chats = append(chats, chatID)
+	}
+	slices.SortFunc(chats, func(a, b uuid.UUID) int { return bytes.Compare(a[:], b[:]) })
+
+	buf := make([]byte, 0, len(chats)*(len(uuid.UUID{})+binary.MaxVarintLen64))
+	for _, chatID := range chats {
+		buf = append(buf, chatID[:]...)
+		buf = binary.AppendUvarint(buf, uint64(c[chatID]+1))
+	}
+	return buf
+}
+
+func unmarshalCursor(buf []byte) (eventCursor, error) {
+	cursor := make(eventCursor)
+	r := bytes.NewReader(buf)
+	for r.Len() > 0 {
+		var chatID uuid.UUID
+		if _, err := io.ReadFull(r, chatID[:]); err != nil {
+			return nil, err
+		}
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if v > math.MaxInt64 {
+			return nil, fmt.Errorf("position %d of chat %s out of range", v, chatID)
+		}
+		cursor[chatID] = int64(v) - 1
+	}
+	return cursor, nil
+}
+
+// diff возвращает позиции, которыми c отличается от снимка base.
+func (c eventCursor) diff(base eventCursor) eventCursor {
+	deltas := make(eventCursor)
+	for chatID, seq := range c {
+		if prev, ok := base[chatID]; !ok || prev != seq {
+			deltas[chatID] = seq
+		}
+	}
+	for chatID := range base {
+		if _, ok := c[chatID]; !ok {
+			deltas[chatID] = removedFromCursor
+		}
+	}
+	return deltas
+}
+
+// apply переносит отличия из id события на загруженный снимок.
+func (c eventCursor) apply(deltas eventCursor) {
+	for chatID, seq := range deltas {
+		if seq == removedFromCursor {
+			delete(c, chatID)
+		} else {
+			c[chatID] = seq
+		}
+	}
+}
+
+// Поток один на все чаты пользователя, и id SSE-события должен
+// восстанавливать позиции во всех разом. Целиком они в него не влезают
+// (прокси режут заголовок Last-Event-ID на нескольких килобайтах), поэтому
+// id — это номер снимка в stream_snapshots и отличия от него.
+func encodeEventID(snapshot uuid.UUID, deltas eventCursor) string {
+	return base64.RawURLEncoding.EncodeToString(append(snapshot[:], deltas.marshal()...))
+}
+
+func decodeEventID(s string) (uuid.UUID, eventCursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	var snapshot uuid.UUID
+	if len(buf) < len(snapshot) {
+		return uuid.Nil, nil, errors.New("event id too short")
+	}
+	copy(snapshot[:], buf)
+	deltas, err := unmarshalCursor(buf[len(snapshot):])
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	for _, seq := range deltas {
+		if seq < removedFromCursor {
+			return uuid.Nil, nil, errors.New("negative position in event id")
+		}
+	}
+	return snapshot, deltas, nil
+}
+
+func saveSnapshot(c *gin.Context, db *db.Database, userID uuid.UUID, cursor eventCursor) (uuid.UUID, error) {
+	var id uuid.UUID
+	err := db.Pool.QueryRow(c.Request.Context(),
+		"INSERT INTO stream_snapshots (user_id, positions) VALUES ($1, $2) RETURNING id",
+		userID, cursor.marshal(),
+	).Scan(&id)
+	return id, err
+}
+
+// loadSnapshot возвращает pgx.ErrNoRows, если снимок уже удалён или
+// принадлежит другому пользователю.
+func loadSnapshot(c *gin.Context, db *db.Database, userID, id uuid.UUID) (eventCursor, error) {
+	var positions []byte
+	err := db.Pool.QueryRow(c.Request.Context(),
+		"SELECT positions FROM stream_snapshots WHERE id = $1 AND user_id = $2",
+		id, userID,
+	).Scan(&positions)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalCursor(positions)
+}
+
+// streamChat — чат пользователя на момент подключения.
+type streamChat struct {
+	id uuid.UUID
+	// joinedAfter — номер события, после которого пользователь вступил
+	// в чат, если эти события ещё в журнале.
+	joinedAfter *int64
+}
+
+func streamChats(c *gin.Context, db *db.Database, userID uuid.UUID) ([]streamChat, error) {
+	rows, err := db.Pool.Query(c.Request.Context(),
+		`SELECT uc.chat_id,
+		        (SELECT min(e.seq) - 1 FROM chat_events e
+		         WHERE e.chat_id = uc.chat_id AND e.created_at >= uc.joined_at)
+		 FROM user_chat uc
+		 WHERE uc.user_id = $1`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (streamChat, error) {
+		var sc streamChat
+		err := row.Scan(&sc.id, &sc.joinedAfter)
+		return sc, err
+	})
+}
+
+func latestSeqs(c *gin.Context, db *db.Database, chats []uuid.UUID) (eventCursor, error) {
+	rows, err := db.Pool.Query(c.Request.Context(),
+		"SELECT id, event_seq FROM chats WHERE id = ANY($1)",
+		chats,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	latest := make(eventCursor, len(chats))
+	for rows.Next() {
+		var chatID uuid.UUID
+		var seq int64
+		if err := rows.Scan(&chatID, &seq); err != nil {
+			return nil, err
+		}
+		latest[chatID] = seq
+	}
+	return latest, rows.Err()
+}
+
+// StreamEvents — те же события, что и /chat/ws, но поверх Server-Sent
+// Events для клиентов за прокси, которые рвут WebSocket. Клиент,
+// переподключившийся с Last-Event-ID, получает только пропущенное.
+func StreamEvents(db *db.Database, hub *Hub, config Config) gin.HandlerFunc {
+	pingInterval := config.PingInterval
+	if pingInterval <= 0 {
+		pingInterval = defaultPingInterval
+	}
+	sendBuffer := config.SendBuffer
+	if sendBuffer <= 0 {
+		sendBuffer = defaultSendBuffer
+	}
+
+	return func(c *gin.Context) {
+		userID, err := uuid.Parse(c.GetString("user_id"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		var resume eventCursor
+		// resync — снимок из Last-Event-ID уже удалён: что пропущено,
+		// не узнать, и клиент перечитывает все чаты.
+		resync := false
+		// snapshot и base — снимок, от которого считаются отличия в id
+		// событий. Переподключение продолжает прежний снимок, чтобы шторм
+		// переподключений не превращался в шторм записей.
+		var snapshot uuid.UUID
+		var base eventCursor
+		if lastID := c.GetHeader("Last-Event-ID"); lastID != "" {
+			ref, deltas, err := decodeEventID(lastID)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid Last-Event-ID"})
+				return
+			}
+			resume, err = loadSnapshot(c, db, userID, ref)
+			switch {
+			case errors.Is(err, pgx.ErrNoRows):
+				resync = true
+			case err != nil:
+				internalError(c, err)
+				return
+			default:
+				snapshot, base = ref, maps.Clone(resume)
+				resume.apply(deltas)
+			}
+		}
+
+		chats, err := streamChats(c, db, userID)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		chatIDs := make([]uuid.UUID, len(chats))
+		for i, sc := range chats {
+			chatIDs[i] = sc.id
+		}
+
+		// Сначала подписка, потом текущие номера: всё, что случится
+		// между ними, либо придёт из хаба, либо будет дочитано из журнала.
+		sub := hub.Subscribe(userID, chatIDs, sendBuffer)
+		defer hub.Unsubscribe(sub)
+		latest, err := latestSeqs(c, db, chatIDs)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		cursor := make(eventCursor, len(chats))
+		for _, sc := range chats {
+			switch seq, ok := resume[sc.id]; {
+			case resync:
+				cursor[sc.id] = latest[sc.id]
+			case ok:
+				cursor[sc.id] = min(seq, latest[sc.id])
+			case resume != nil && sc.joinedAfter != nil:
+				// Вступил в чат, пока был отключён.
+				cursor[sc.id] = *sc.joinedAfter
+			default:
+				cursor[sc.id] = latest[sc.id]
+			}
+		}
+		if base == nil || len(cursor.diff(base)) > maxCursorDeltas {
+			if snapshot, err = saveSnapshot(c, db, userID, cursor); err != nil {
+				internalError(c, err)
+				return
+			}
+			base = maps.Clone(cursor)
+		}
+		// eventID пишет новый снимок, когда отличий накопилось много; если
+		// запись не удалась, id просто остаётся длиннее.
+		eventID := func() string {
+			deltas := cursor.diff(base)
+			if len(deltas) > maxCursorDeltas {
+				if id, err := saveSnapshot(c, db, userID, cursor); err != nil {
+					log.Printf("Failed to save stream snapshot of user %s: %v", userID, err)
+				} else {
+					snapshot, base, deltas = id, maps.Clone(cursor), nil
+				}
+			}
+			return encodeEventID(snapshot, deltas)
+		}
+
+		c.Header("Content-Type", sse.ContentType)
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		// nginx иначе копит ответ в буфере и события приходят пачками.
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+
+		send := func(event ChatEvent) {
+			switch {
+			case event.Seq == 0 || event.Type == EventChatDeleted:
+				delete(cursor, event.ChatID)
+			case event.Type == EventMemberRemoved && removesUser(event, userID):
+				delete(cursor, event.ChatID)
+			default:
+				cursor[event.ChatID] = event.Seq
+			}
+			c.Render(-1, sse.Event{Id: eventID(), Event: event.Type, Data: event})
+		}
+		// catchUp отправляет события чата с after+1 по upto из журнала.
+		catchUp := func(chatID uuid.UUID, after, upto int64) error {
+			events, err := hub.replay(c.Request.Context(), chatID, after, upto)
+			if err != nil {
+				return err
+			}
+			for _, e := range events {
+				send(e)
+			}
+			cursor[chatID] = upto
+			return nil
+		}
+
+		c.Render(-1, sse.Event{Id: eventID(), Event: "ready", Retry: 3000, Data: gin.H{"chats": chatIDs}})
+		for _, chatID := range chatIDs {
+			switch {
+			case resync && latest[chatID] > 0:
+				event := newChatEvent(EventChatResync, chatID, nil)
+				event.Seq = latest[chatID]
+				send(event)
+			case cursor[chatID] < latest[chatID]:
+				if err := catchUp(chatID, cursor[chatID], latest[chatID]); err != nil {
+					writeStreamError(c, err)
+					return
+				}
+			}
+		}
+		c.Writer.Flush()
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+		ended := watchSession(ctx, c, config.RevalidateInterval)
+
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case event := <-sub.Events():
+				pos, known := cursor[event.ChatID]
+				switch {
+				case event.Seq != 0 && known && event.Seq <= pos:
+					// Уже отправлено при дочитывании журнала.
+					continue
+				case event.Seq != 0 && known && event.Seq > pos+1:
+					// Уведомления разных экземпляров могут обгонять друг друга.
+					if err := catchUp(event.ChatID, pos, event.Seq-1); err != nil {
+						writeStreamError(c, err)
+						return
+					}
+				}
+				send(event)
+				c.Writer.Flush()
+			case <-ticker.C:
+				if _, err := io.WriteString(c.Writer, ": ping\n\n"); err != nil {
+					return
+				}
+				c.Writer.Flush()
+			case <-sub.Done():
+				writeStreamError(c, errors.New("slow consumer"))
+				return
+			case reason := <-ended:
+				writeStreamError(c, errors.New(reason))
+				return
+			case <-c.Request.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func removesUser(event ChatEvent, userID uuid.UUID) bool {
+	var members membersData
+	if err := json.Unmarshal(event.Data, &members); err != nil {
+		return false
+	}
+	return slices.Contains(members.UserIDs, userID)
+}
+
+// writeStreamError сообщает клиенту причину разрыва; он переподключится
+// с последним Last-Event-ID и ничего не потеряет.
+func writeStreamError(c *gin.Context, err error) {
+	c.Render(-1, sse.Event{Event: "error", Data: gin.H{"error": fmt.Sprint(err)}})
+	c.Writer.Flush()
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/base64"
+	"maps"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestEventIDRoundTrip(t *testing.T) {
+	snapshot := uuid.New()
+	tests := map[string]eventCursor{
+		"empty":   {},
+		"zero":    {uuid.New(): 0},
+		"removed": {uuid.New(): removedFromCursor, uuid.New(): 7},
+		"large":   {uuid.New(): 1 << 40},
+	}
+	for name, deltas := range tests {
+		t.Run(name, func(t *testing.T) {
+			gotSnapshot, gotDeltas, err := decodeEventID(encodeEventID(snapshot, deltas))
+			if err != nil {
+				t.Fatalf("decodeEventID: %v", err)
+			}
+			if gotSnapshot != snapshot || !maps.Equal(gotDeltas, deltas) {
+				t.Errorf("got %s %v, want %s %v", gotSnapshot, gotDeltas, snapshot, deltas)
+			}
+		})
+	}
+}
+
+func TestDecodeEventIDRejectsMalformed(t *testing.T) {
+	chatID, snapshot := uuid.New(), uuid.New()
+	valid := snapshot[:]
+	tests := map[string]string{
+		"not base64":      "!!!",
+		"short snapshot":  base64.RawURLEncoding.EncodeToString(make([]byte, 8)),
+		"truncated chat":  base64.RawURLEncoding.EncodeToString(append(valid, chatID[:5]...)),
+		"missing seq":     base64.RawURLEncoding.EncodeToString(append(valid, chatID[:]...)),
+		"unterminated":    base64.RawURLEncoding.EncodeToString(append(append(valid, chatID[:]...), 0x80)),
+		"seq over int64":  base64.RawURLEncoding.EncodeToString(append(append(valid, chatID[:]...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)),
+		"old full cursor": base64.RawURLEncoding.EncodeToString(append(chatID[:], 0x05)),
+	}
+	for name, id := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := decodeEventID(id); err == nil {
+				t.Errorf("decodeEventID(%q) succeeded", id)
+			}
+		})
+	}
+}
+
+func TestCursorDiffApply(t *testing.T) {
+	kept, moved, left, joined := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	base := eventCursor{kept: 3, moved: 5, left: 9}
+	cursor := eventCursor{kept: 3, moved: 8, joined: 1}
+
+	deltas := cursor.diff(base)
+	want := eventCursor{moved: 8, joined: 1, left: removedFromCursor}
+	if !maps.Equal(deltas, want) {
+		t.Fatalf("diff = %v, want %v", deltas, want)
+	}
+
+	restored := maps.Clone(base)
+	restored.apply(deltas)
+	if !maps.Equal(restored, cursor) {
+		t.Errorf("apply = %v, want %v", restored, cursor)
+	}
+}
+
+func TestEventIDSizeIsBounded(t *testing.T) {
+	deltas := make(eventCursor, maxCursorDeltas)
+	for range maxCursorDeltas {
+		deltas[uuid.New()] = 1<<63 - 1
+	}
+	// Заголовок Last-Event-ID должен проходить через прокси с запасом.
+	if id := encodeEventID(uuid.New(), deltas); len(id) > 1024 {
+		t.Errorf("event id with %d deltas is %d bytes, want at most 1024", maxCursorDeltas, len(id))
+	}
+}
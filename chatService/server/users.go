@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// batchLimit совпадает с ограничением /auth/users/batch.
+const batchLimit = 100
+
+type UserInfo struct {
+	ID          uuid.UUID `json:"id"`
+	Username    string    `json:"username"`
+	DisplayName *string   `json:"display_name"`
+	Avatar      *string   `json:"avatar"`
+}
+
+// UserDirectory подтягивает профили из authService пачками и кеширует их,
+// включая отсутствующих пользователей, чтобы не спрашивать о них снова.
+type UserDirectory struct {
+	authURL string
+	token   string
+	client  *http.Client
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	cache map[uuid.UUID]userEntry
+}
+
+type userEntry struct {
+	user  *UserInfo
+	until time.Time
+}
+
+func NewUserDirectory(authURL, token string, ttl time.Duration) *UserDirectory {
+	return &UserDirectory{
+		authURL: authURL,
+		token:   token,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		ttl:     ttl,
+		cache:   make(map[uuid.UUID]userEntry),
+	}
+}
+
+// Lookup возвращает известных authService пользователей из ids.
+func (d *UserDirectory) Lookup(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]UserInfo, error) {
+	now := time.Now()
+	users := make(map[uuid.UUID]UserInfo, len(ids))
+	seen := make(map[uuid.UUID]bool, len(ids))
+	var missing []uuid.UUID
+
+	d.mu.Lock()
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		entry, ok := d.cache[id]
+		if !ok || now.After(entry.until) {
+			missing = append(missing, id)
+			continue
+		}
+		if entry.user != nil {
+			users[id] = *entry.user
+		}
+	}
+	d.mu.Unlock()
+
+	for start := 0; start < len(missing); start += batchLimit {
+		chunk := missing[start:min(start+batchLimit, len(missing))]
+		fetched, err := d.fetch(ctx, chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		until := time.Now().Add(d.ttl)
+		d.mu.Lock()
+		for _, id := range chunk {
+			entry := userEntry{until: until}
+			if u, ok := fetched[id]; ok {
+				entry.user = &u
+				users[id] = u
+			}
+			d.cache[id] = entry
+		}
+		d.mu.Unlock()
+	}
+
+	d.mu.Lock()
+	for k, e := range d.cache {
+		if now.After(e.until) {
+			delete(d.cache, k)
+		}
+	}
+	d.mu.Unlock()
+
+	return users, nil
+}
+
+func (d *UserDirectory) fetch(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]UserInfo, error) {
+	body, err := json.Marshal(map[string][]uuid.UUID{"ids": ids})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.authURL+"/auth/users/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+d.token)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach auth service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth service returned %s", resp.Status)
+	}
+
+	var result struct {
+		Users []UserInfo `json:"users"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode users response: %w", err)
+	}
+
+	users := make(map[uuid.UUID]UserInfo, len(result.Users))
+	for _, u := range result.Users {
+		users[u.ID] = u
+	}
+	return users, nil
+}
+
+// includeUsers дополняет ответ профилями авторов, если клиент попросил
+// ?expand=users. Недоступность authService не ломает основной ответ.
+func includeUsers(c *gin.Context, users *UserDirectory, response gin.H, ids []uuid.UUID) {
+	if users == nil || c.Query("expand") != "users" {
+		return
+	}
+	info, err := users.Lookup(c.Request.Context(), ids)
+	if err != nil {
+		log.Printf("Failed to look up users: %v", err)
+		return
+	}
+	response["users"] = info
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"chatService/db"
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	writeWait = 10 * time.Second
+	// Клиенту писать в сокет незачем, большие сообщения считаем ошибкой.
+	maxClientMessage = 4096
+
+	defaultPingInterval = 30 * time.Second
+	defaultSendBuffer   = 64
+
+	// closeSessionEnded — код закрытия из диапазона приложения: токен
+	// истёк или отозван, клиенту нужен новый.
+	closeSessionEnded = 4401
+)
+
+func userChats(ctx context.Context, db *db.Database, userID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := db.Pool.Query(ctx, "SELECT chat_id FROM user_chat WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+}
+
+// ServeWS подписывает подключение на все чаты пользователя и пересылает
+// ему события. Соединение закрывается, если клиент не отвечает на ping
+// или не успевает читать события.
+func ServeWS(db *db.Database, hub *Hub, config Config) gin.HandlerFunc {
+	pingInterval := config.PingInterval
+	if pingInterval <= 0 {
+		pingInterval = defaultPingInterval
+	}
+	sendBuffer := config.SendBuffer
+	if sendBuffer <= 0 {
+		sendBuffer = defaultSendBuffer
+	}
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 4096,
+		// Доступ определяется токеном, а не cookie, так что чужой Origin
+		// ничего не получит без токена пользователя.
+		CheckOrigin:  func(r *http.Request) bool { return true },
+		Subprotocols: []string{wsTokenProtocol},
+	}
+
+	return func(c *gin.Context) {
+		userID, err := uuid.Parse(c.GetString("user_id"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		chats, err := userChats(c.Request.Context(), db, userID)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			// Upgrader уже ответил клиенту.
+			log.Printf("WebSocket upgrade failed: %v", err)
+			return
+		}
+
+		sub := hub.Subscribe(userID, chats, sendBuffer)
+		defer hub.Unsubscribe(sub)
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+		ended := watchSession(ctx, c, config.RevalidateInterval)
+
+		readerDone := make(chan struct{})
+		go readPump(conn, 2*pingInterval, readerDone)
+		writePump(conn, sub, pingInterval, readerDone, ended)
+	}
+}
+
+// readPump только следит за живостью клиента: входящие сообщения
+// отбрасываются, pong продлевает срок ожидания.
+func readPump(conn *websocket.Conn, pongWait time.Duration, done chan<- struct{}) {
+	defer close(done)
+	conn.SetReadLimit(maxClientMessage)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+func writePump(conn *websocket.Conn, sub *Subscriber, pingInterval time.Duration, readerDone <-chan struct{}, ended <-chan string) {
+	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case event := <-sub.Events():
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-sub.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer"),
+				time.Now().Add(writeWait))
+			return
+		case reason := <-ended:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(closeSessionEnded, reason),
+				time.Now().Add(writeWait))
+			return
+		case <-readerDone:
+			return
+		}
+	}
+}
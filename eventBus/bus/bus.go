@@ -0,0 +1,68 @@
+// Package bus описывает шину доменных событий между сервисами. Шина
+// присваивает каждому событию позицию в потоке; потребители хранят
+// последнюю обработанную позицию сами и подписываются с неё же.
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Event struct {
+	ID         uuid.UUID       `json:"id"`
+	Type       string          `json:"type"`
+	Source     string          `json:"source"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// Subject — тема, под которой событие публикуется, например events.auth.user.deleted.
+func (e Event) Subject() string {
+	return "events." + e.Source + "." + e.Type
+}
+
+type Delivery struct {
+	Event
+	// Position — номер события в потоке шины, растёт строго монотонно.
+	Position uint64
+}
+
+// Handler обрабатывает событие. Пока он возвращает ошибку, то же событие
+// доставляется снова, а следующие ждут.
+type Handler func(ctx context.Context, d Delivery) error
+
+type Bus interface {
+	// Publish возвращает nil, только когда шина приняла событие.
+	Publish(ctx context.Context, event Event) error
+	// Subscribe доставляет события начиная с позиции from по порядку,
+	// пока не отменён ctx.
+	Subscribe(ctx context.Context, consumer string, from uint64, handler Handler) error
+	// Stream называет поток, в котором считаются позиции. Позиция имеет
+	// смысл только вместе с ним: новый поток снова начинается с 1.
+	Stream() string
+	Close() error
+}
+
+const maxRetryDelay = 30 * time.Second
+
+// deliver вызывает handler, пока тот не справится или не отменится ctx.
+func deliver(ctx context.Context, consumer string, d Delivery, handler Handler) bool {
+	delay := 100 * time.Millisecond
+	for {
+		err := handler(ctx, d)
+		if err == nil {
+			return true
+		}
+		log.Printf("Consumer %s failed on event %s (%s) at position %d: %v", consumer, d.ID, d.Type, d.Position, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
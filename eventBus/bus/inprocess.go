@@ -0,0 +1,123 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+var ErrClosed = errors.New("bus is closed")
+
+// InProcess — шина внутри одного процесса. Журнал живёт в памяти, поэтому
+// события не переживают перезапуск и не покидают сервис; годится для
+// разработки и для подписчиков в том же процессе.
+type InProcess struct {
+	mu      sync.Mutex
+	stream  string
+	changed chan struct{}
+	log     []Delivery
+	// first — позиция log[0]; всё, что все подписчики уже прошли, отрезается.
+	first   uint64
+	cursors map[*uint64]struct{}
+	closed  bool
+}
+
+func NewInProcess() *InProcess {
+	return &InProcess{
+		stream:  "inprocess:" + uuid.NewString(),
+		changed: make(chan struct{}),
+		first:   1,
+		cursors: make(map[*uint64]struct{}),
+	}
+}
+
+// Stream у каждого экземпляра свой: после перезапуска позиции снова идут с 1.
+func (b *InProcess) Stream() string {
+	return b.stream
+}
+
+func (b *InProcess) Publish(ctx context.Context, event Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	b.log = append(b.log, Delivery{Event: event, Position: b.first + uint64(len(b.log))})
+	close(b.changed)
+	b.changed = make(chan struct{})
+	return nil
+}
+
+func (b *InProcess) Subscribe(ctx context.Context, consumer string, from uint64, handler Handler) error {
+	next := max(from, 1)
+	b.mu.Lock()
+	b.cursors[&next] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		defer func() {
+			b.mu.Lock()
+			delete(b.cursors, &next)
+			b.mu.Unlock()
+		}()
+		for {
+			b.mu.Lock()
+			if next < b.first {
+				next = b.first
+			}
+			var d Delivery
+			i := next - b.first
+			ready := i < uint64(len(b.log))
+			if ready {
+				d = b.log[i]
+			}
+			changed, closed := b.changed, b.closed
+			b.mu.Unlock()
+
+			if closed {
+				return
+			}
+			if !ready {
+				select {
+				case <-ctx.Done():
+					return
+				case <-changed:
+				}
+				continue
+			}
+
+			if !deliver(ctx, consumer, d, handler) {
+				return
+			}
+			b.mu.Lock()
+			next++
+			b.trim()
+			b.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// trim отбрасывает события, которые прошли все подписчики.
+func (b *InProcess) trim() {
+	lowest := b.first + uint64(len(b.log))
+	for cursor := range b.cursors {
+		lowest = min(lowest, *cursor)
+	}
+	if drop := lowest - b.first; drop > 0 {
+		b.log = append([]Delivery(nil), b.log[drop:]...)
+		b.first = lowest
+	}
+}
+
+func (b *InProcess) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.changed)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func publishN(t *testing.T, b *InProcess, n int) []uuid.UUID {
+	t.Helper()
+	ids := make([]uuid.UUID, n)
+	for i := range ids {
+		ids[i] = uuid.New()
+		if err := b.Publish(context.Background(), Event{ID: ids[i], Type: "test"}); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	return ids
+}
+
+func receive(t *testing.T, ch <-chan Delivery) Delivery {
+	t.Helper()
+	select {
+	case d := <-ch:
+		return d
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delivery within 2s")
+		return Delivery{}
+	}
+}
+
+func TestInProcessDeliversInOrderFromPosition(t *testing.T) {
+	b := NewInProcess()
+	defer b.Close()
+	ids := publishN(t, b, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan Delivery, 10)
+	err := b.Subscribe(ctx, "test", 2, func(_ context.Context, d Delivery) error {
+		got <- d
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	for _, want := range []struct {
+		pos uint64
+		id  uuid.UUID
+	}{{2, ids[1]}, {3, ids[2]}} {
+		d := receive(t, got)
+		if d.Position != want.pos || d.ID != want.id {
+			t.Errorf("got %s at %d, want %s at %d", d.ID, d.Position, want.id, want.pos)
+		}
+	}
+
+	late := publishN(t, b, 1)
+	if d := receive(t, got); d.Position != 4 || d.ID != late[0] {
+		t.Errorf("got %s at %d, want %s at 4", d.ID, d.Position, late[0])
+	}
+}
+
+func TestInProcessRetriesFailedHandler(t *testing.T) {
+	b := NewInProcess()
+	defer b.Close()
+	publishN(t, b, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan Delivery, 10)
+	failures := 2
+	err := b.Subscribe(ctx, "test", 1, func(_ context.Context, d Delivery) error {
+		if d.Position == 1 && failures > 0 {
+			failures--
+			return errors.New("boom")
+		}
+		got <- d
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	for _, want := range []uint64{1, 2} {
+		if d := receive(t, got); d.Position != want {
+			t.Errorf("got position %d, want %d", d.Position, want)
+		}
+	}
+}
+
+func TestInProcessTrimsConsumedEvents(t *testing.T) {
+	b := NewInProcess()
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan Delivery, 10)
+	err := b.Subscribe(ctx, "test", 1, func(_ context.Context, d Delivery) error {
+		got <- d
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	publishN(t, b, 3)
+	for range 3 {
+		receive(t, got)
+	}
+
+	// Курсор сдвигается уже после обработчика, поэтому ждём обрезки.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b.mu.Lock()
+		size, first := len(b.log), b.first
+		b.mu.Unlock()
+		if size == 0 && first == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("log not trimmed: %d events from %d", size, first)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInProcessStreamIsPerInstance(t *testing.T) {
+	a, b := NewInProcess(), NewInProcess()
+	if a.Stream() == b.Stream() {
+		t.Errorf("two buses share stream %q, offsets would carry over a restart", a.Stream())
+	}
+}
+
+func TestInProcessPublishAfterClose(t *testing.T) {
+	b := NewInProcess()
+	b.Close()
+	if err := b.Publish(context.Background(), Event{ID: uuid.New()}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Publish after Close = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,114 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATS публикует события в поток JetStream. Позиция события — его номер
+// в потоке. Повторная публикация того же события в пределах окна
+// дедупликации отбрасывается сервером по Nats-Msg-Id.
+type NATS struct {
+	conn   *nats.Conn
+	js     jetstream.JetStream
+	stream jetstream.Stream
+	id     string
+}
+
+func NewNATS(ctx context.Context, url, streamName string) (*NATS, error) {
+	conn, err := nats.Connect(url, nats.Name("4at20"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:       streamName,
+		Subjects:   []string{"events.>"},
+		Storage:    jetstream.FileStorage,
+		Duplicates: 10 * time.Minute,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create stream %s: %w", streamName, err)
+	}
+	// Пересозданный поток нумерует события заново, поэтому в имя входит
+	// ещё и время его создания.
+	id := fmt.Sprintf("nats:%s@%d", streamName, stream.CachedInfo().Created.UnixNano())
+	return &NATS{conn: conn, js: js, stream: stream, id: id}, nil
+}
+
+func (b *NATS) Stream() string {
+	return b.id
+}
+
+func (b *NATS) Publish(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = b.js.Publish(ctx, event.Subject(), data, jetstream.WithMsgID(event.ID.String()))
+	return err
+}
+
+// Subscribe читает поток упорядоченным потребителем. Подтверждения в NATS
+// не нужны: позицию хранит сам потребитель и передаёт её в from.
+func (b *NATS) Subscribe(ctx context.Context, consumer string, from uint64, handler Handler) error {
+	config := jetstream.OrderedConsumerConfig{DeliverPolicy: jetstream.DeliverAllPolicy}
+	if from > 1 {
+		config.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		config.OptStartSeq = from
+	}
+	cons, err := b.stream.OrderedConsumer(ctx, config)
+	if err != nil {
+		return fmt.Errorf("failed to create consumer %s: %w", consumer, err)
+	}
+	msgs, err := cons.Messages()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		msgs.Stop()
+	}()
+	go func() {
+		for {
+			msg, err := msgs.Next()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Consumer %s stopped: %v", consumer, err)
+				}
+				return
+			}
+			meta, err := msg.Metadata()
+			if err != nil {
+				log.Printf("Consumer %s got message without metadata: %v", consumer, err)
+				continue
+			}
+			var d Delivery
+			if err := json.Unmarshal(msg.Data(), &d.Event); err != nil {
+				log.Printf("Consumer %s skipped malformed event at position %d: %v", consumer, meta.Sequence.Stream, err)
+				continue
+			}
+			d.Position = meta.Sequence.Stream
+			if !deliver(ctx, consumer, d, handler) {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *NATS) Close() error {
+	return b.conn.Drain()
+}